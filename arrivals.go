@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/ftwynn/gologgen/loggensender"
+)
+
+// arrivalState is what an arrival model remembers between sends of a line
+type arrivalState struct {
+	// burstEnd is when the current on period of a bursty line ends
+	burstEnd time.Time
+}
+
+// validateArrivalModel checks a line's ArrivalModel and its settings
+func validateArrivalModel(logLine loggensender.LogLineProperties) error {
+	switch logLine.ArrivalModel {
+	case "", "normal", "fixed", "poisson":
+	case "bursty":
+		if logLine.BurstOnSecs <= 0 || logLine.BurstOffSecs <= 0 {
+			return errors.New("Bursty lines need a positive BurstOnSecs and BurstOffSecs")
+		}
+	default:
+		return errors.New("ArrivalModel field must be in (normal, fixed, poisson, bursty): " + logLine.ArrivalModel)
+	}
+
+	return nil
+}
+
+// lineIntervalMillis gives the mean interval and its standard deviation of a
+// line in milliseconds. IntervalMillis takes precedence over IntervalSecs.
+func lineIntervalMillis(logline loggensender.LogLineProperties) (mean float64, stdDev float64) {
+	if logline.IntervalMillis != 0 {
+		return float64(logline.IntervalMillis), float64(logline.IntervalStdDevMillis)
+	}
+	return float64(logline.IntervalSecs) * 1000, logline.IntervalStdDev * 1000
+}
+
+// nextArrival works out when a line should next be sent, given when it was
+// last sent and how much faster than normal it should currently run
+func nextArrival(logline loggensender.LogLineProperties, state arrivalState, from time.Time, multiplier float64, r *rand.Rand) (time.Time, arrivalState) {
+	mean, stdDev := lineIntervalMillis(logline)
+	mean /= multiplier
+	stdDev /= multiplier
+
+	millis := func(ms float64) time.Duration {
+		return time.Duration(ms * float64(time.Millisecond))
+	}
+
+	switch logline.ArrivalModel {
+	case "fixed":
+		return from.Add(millis(mean)), state
+	case "poisson":
+		return from.Add(millis(r.ExpFloat64() * mean)), state
+	case "bursty":
+		// On and off periods have random (exponential) lengths, and sends
+		// during an on period are a Poisson process. Nothing is sent while off.
+		onMillis := float64(logline.BurstOnSecs) * 1000
+		offMillis := float64(logline.BurstOffSecs) * 1000
+
+		if state.burstEnd.IsZero() {
+			state.burstEnd = from.Add(millis(r.ExpFloat64() * onMillis))
+		}
+
+		next := from.Add(millis(r.ExpFloat64() * mean))
+		for !next.Before(state.burstEnd) {
+			offEnd := state.burstEnd.Add(millis(r.ExpFloat64() * offMillis))
+			state.burstEnd = offEnd.Add(millis(r.ExpFloat64() * onMillis))
+			next = offEnd.Add(millis(r.ExpFloat64() * mean))
+		}
+		return next, state
+	default:
+		// A normal distribution can go negative, which would mean sending in
+		// the past, so send straight away instead
+		return from.Add(millis(math.Max(r.NormFloat64()*stdDev+mean, 0))), state
+	}
+}
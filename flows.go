@@ -0,0 +1,346 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/ftwynn/gologgen/loggenmunger"
+	"github.com/ftwynn/gologgen/loggensender"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// FlowDefinition describes a session or transaction: an ordered (or Markov)
+// sequence of steps that share variables, with many instances running at once
+type FlowDefinition struct {
+	Name            string                           `json:"Name"`
+	ArrivalRate     float64                          `json:"ArrivalRate"`
+	MaxConcurrent   int                              `json:"MaxConcurrent"`
+	MaxSteps        int                              `json:"MaxSteps"`
+	RateProfile     string                           `json:"RateProfile"`
+	TimestampFormat string                           `json:"TimestampFormat"`
+	Headers         []loggensender.LogLineHTTPHeader `json:"Headers"`
+	Variables       []FlowVariable                   `json:"Variables"`
+	Steps           []FlowStep                       `json:"Steps"`
+	SourceFile      string                           `json:"-"`
+}
+
+// FlowVariable is set once when a flow instance starts. The value can use
+// any token, including variables defined before it.
+type FlowVariable struct {
+	Name  string `json:"Name"`
+	Value string `json:"Value"`
+}
+
+// FlowStep is one line of a flow, sent after a delay from the previous step
+type FlowStep struct {
+	loggensender.LogLineProperties
+	Name              string           `json:"Name"`
+	DelayMillis       int              `json:"DelayMillis"`
+	DelayStdDevMillis int              `json:"DelayStdDevMillis"`
+	Next              []FlowTransition `json:"Next"`
+}
+
+// FlowTransition is the probability of moving to a named step next. Any
+// probability left over ends the flow.
+type FlowTransition struct {
+	Step        string  `json:"Step"`
+	Probability float64 `json:"Probability"`
+}
+
+// defaultFlowMaxSteps keeps Markov flows with loops from running forever
+const defaultFlowMaxSteps = 100
+
+// validateFlows does sanity checks on the flows in a data file, aborting if
+// a flow couldn't run
+func validateFlows(flows []FlowDefinition) {
+	names := make(map[string]bool)
+	for _, flow := range flows {
+		if flow.Name == "" || names[flow.Name] {
+			log.WithFields(log.Fields{
+				"Name": flow.Name,
+			}).Fatal("Flows must have a unique, non-blank name in data file JSON")
+		}
+		names[flow.Name] = true
+
+		if flow.ArrivalRate <= 0 {
+			log.WithFields(log.Fields{
+				"flow":        flow.Name,
+				"ArrivalRate": flow.ArrivalRate,
+			}).Fatal("Flow ArrivalRate must be a positive number of new flows per second in data file JSON")
+		}
+
+		if _, ok := rateProfiles[flow.RateProfile]; flow.RateProfile != "" && !ok {
+			log.WithFields(log.Fields{
+				"flow":        flow.Name,
+				"RateProfile": flow.RateProfile,
+			}).Fatal("Flow RateProfile doesn't match a rate profile in the global config")
+		}
+
+		if flow.MaxConcurrent < 0 || flow.MaxSteps < 0 {
+			log.WithFields(log.Fields{
+				"flow": flow.Name,
+			}).Fatal("Flow MaxConcurrent and MaxSteps cannot be negative in data file JSON")
+		}
+
+		if len(flow.Steps) == 0 {
+			log.WithFields(log.Fields{
+				"flow": flow.Name,
+			}).Fatal("Flows must have at least one step in data file JSON")
+		}
+
+		for _, variable := range flow.Variables {
+			if variable.Name == "" {
+				log.WithFields(log.Fields{
+					"flow": flow.Name,
+				}).Fatal("Flow variables must have a non-blank name in data file JSON")
+			}
+			if err := loggenmunger.ValidateTokens(variable.Value); err != nil {
+				log.WithFields(log.Fields{
+					"flow":      flow.Name,
+					"variable":  variable.Name,
+					"error_msg": err,
+				}).Fatal("Flow variable Value has an invalid wildcard in data file JSON")
+			}
+		}
+
+		stepNames := make(map[string]bool)
+		for _, step := range flow.Steps {
+			if step.Name != "" {
+				stepNames[step.Name] = true
+			}
+		}
+
+		for _, step := range flow.Steps {
+			if step.Text == "" && step.Engine != "json" {
+				log.WithFields(log.Fields{
+					"flow": flow.Name,
+					"step": step.Name,
+				}).Fatal("Flow steps must have a Text field in data file JSON")
+			}
+
+			if err := validateLineEngine(step.LogLineProperties); err != nil {
+				log.WithFields(log.Fields{
+					"flow":      flow.Name,
+					"step":      step.Name,
+					"error_msg": err,
+				}).Fatal("Flow step has an invalid Text or Fields in data file JSON")
+			}
+
+			if step.DelayMillis < 0 || step.DelayStdDevMillis < 0 {
+				log.WithFields(log.Fields{
+					"flow": flow.Name,
+					"step": step.Name,
+				}).Fatal("Flow step delays cannot be negative in data file JSON")
+			}
+
+			timestampFormat := step.TimestampFormat
+			if timestampFormat == "" {
+				timestampFormat = flow.TimestampFormat
+			}
+			if err := loggenmunger.ValidateTimeFormat(timestampFormat); err != nil {
+				log.WithFields(log.Fields{
+					"flow":      flow.Name,
+					"step":      step.Name,
+					"error_msg": err,
+				}).Fatal("Flow steps need a valid TimestampFormat, on the step or the flow, in data file JSON")
+			}
+
+			var total float64
+			for _, next := range step.Next {
+				if !stepNames[next.Step] || next.Probability < 0 {
+					log.WithFields(log.Fields{
+						"flow": flow.Name,
+						"step": step.Name,
+						"next": next.Step,
+					}).Fatal("Flow step transitions must name another step and have a non-negative Probability in data file JSON")
+				}
+				total += next.Probability
+			}
+			if total > 1.000001 {
+				log.WithFields(log.Fields{
+					"flow":  flow.Name,
+					"step":  step.Name,
+					"total": total,
+				}).Fatal("Flow step transition probabilities cannot add up to more than 1 in data file JSON")
+			}
+		}
+	}
+}
+
+// prepareFlowSteps fills in each step's line properties from the flow
+func prepareFlowSteps(flow *FlowDefinition, confData *GlobalConfStore) {
+	if flow.RateProfile == "" {
+		flow.RateProfile = confData.RateProfile
+	}
+
+	for i := range flow.Steps {
+		step := &flow.Steps[i]
+
+		stepID := step.Name
+		if stepID == "" {
+			stepID = strconv.Itoa(i)
+		}
+		step.LineID = flow.SourceFile + ":" + flow.Name + ":" + stepID
+		step.SourceFile = flow.SourceFile
+
+		if step.TimestampFormat == "" {
+			step.TimestampFormat = flow.TimestampFormat
+		}
+		if len(step.Headers) == 0 {
+			step.Headers = flow.Headers
+		}
+
+		applyLineDefaults(&step.LogLineProperties, confData)
+	}
+}
+
+// flowArrivals starts the instances of a flow and keeps count of the ones
+// running. Like the instances, it's only used in the scheduler's goroutine.
+type flowArrivals struct {
+	flow      FlowDefinition
+	scheduler *lineScheduler
+	active    int
+
+	// waiting is set when an instance was due to start with MaxConcurrent
+	// already running, and it starts as soon as one ends
+	waiting bool
+}
+
+// flowInstance is one run through a flow's steps
+type flowInstance struct {
+	arrivals  *flowArrivals
+	vars      map[string]string
+	stepIndex int
+	count     int
+	maxSteps  int
+}
+
+// startFlows schedules the first instance of each flow
+func startFlows(flows []FlowDefinition, tickerStart time.Time, scheduler *lineScheduler) {
+	for _, flow := range flows {
+		arrivals := &flowArrivals{flow: flow, scheduler: scheduler}
+		scheduler.schedule(tickerStart, arrivals.arrive)
+	}
+}
+
+// arrive starts a new instance of the flow and works out when the next one
+// is due. While MaxConcurrent instances are running, it waits for one to end.
+func (a *flowArrivals) arrive(due time.Time) (time.Time, bool) {
+	if a.flow.MaxConcurrent > 0 && a.active >= a.flow.MaxConcurrent {
+		a.waiting = true
+		return due, false
+	}
+
+	a.start(due)
+	return a.nextArrival(due), true
+}
+
+// nextArrival picks the time of the next instance with an exponentially
+// distributed gap, so arrivals follow a Poisson process at ArrivalRate
+func (a *flowArrivals) nextArrival(from time.Time) time.Time {
+	gap := a.scheduler.r.ExpFloat64() / (a.flow.ArrivalRate * rateProfileMultiplier(a.flow.RateProfile, from))
+	return from.Add(time.Duration(gap * float64(time.Second)))
+}
+
+// start sets a new instance's variables and schedules its first step
+func (a *flowArrivals) start(at time.Time) {
+	log.WithFields(log.Fields{
+		"flow": a.flow.Name,
+	}).Debug("Starting new flow instance")
+
+	// Variables are fixed for the life of the instance, so the map is only
+	// written here and is safe for the workers to read
+	vars := make(map[string]string)
+	scope := loggenmunger.TokenScope{LineID: a.flow.SourceFile + ":" + a.flow.Name + ":vars", SourceFile: a.flow.SourceFile, Vars: vars}
+	for _, variable := range a.flow.Variables {
+		vars[variable.Name] = loggenmunger.RandomizeString(variable.Value, a.flow.TimestampFormat, scope)
+	}
+
+	maxSteps := a.flow.MaxSteps
+	if maxSteps == 0 {
+		maxSteps = defaultFlowMaxSteps
+	}
+
+	a.active++
+	instance := &flowInstance{arrivals: a, vars: vars, maxSteps: maxSteps}
+	a.scheduler.schedule(at.Add(instance.delay(0)), instance.step)
+}
+
+// finish ends an instance, starting the instance that was waiting for it
+func (a *flowArrivals) finish(at time.Time) {
+	a.active--
+	if a.waiting {
+		a.waiting = false
+		a.start(at)
+		a.scheduler.schedule(a.nextArrival(at), a.arrive)
+	}
+}
+
+// delay picks how long to wait before a step
+func (i *flowInstance) delay(stepIndex int) time.Duration {
+	step := i.arrivals.flow.Steps[stepIndex]
+	delay := i.arrivals.scheduler.r.NormFloat64()*float64(step.DelayStdDevMillis) + float64(step.DelayMillis)
+	return time.Duration(math.Max(delay, 0) * float64(time.Millisecond))
+}
+
+// step sends the instance's current step, and works out when the next one
+// is due, or ends the instance
+func (i *flowInstance) step(due time.Time) (time.Time, bool) {
+	flow := i.arrivals.flow
+	step := flow.Steps[i.stepIndex]
+
+	line := step.LogLineProperties
+	line.Vars = i.vars
+
+	// Scenarios can override tokens in flow steps or silence them, but
+	// flows keep their own pace
+	line, _, silenced := applyScenarios(line, due)
+
+	if !silenced {
+		log.WithFields(log.Fields{
+			"flow": flow.Name,
+			"step": step.Name,
+		}).Debug("Queuing flow step")
+
+		line.ScheduledAt = due
+		i.arrivals.scheduler.runQueue <- line
+	}
+
+	i.count++
+	i.stepIndex = nextFlowStep(flow, i.stepIndex, i.arrivals.scheduler.r)
+	if i.stepIndex != -1 && i.count < i.maxSteps {
+		return due.Add(i.delay(i.stepIndex)), true
+	}
+
+	i.arrivals.finish(due)
+	return due, false
+}
+
+// nextFlowStep picks the index of the step after the current one, or -1 if
+// the flow is over. Steps without transitions move on to the following step.
+func nextFlowStep(flow FlowDefinition, current int, r *rand.Rand) int {
+	step := flow.Steps[current]
+	if len(step.Next) == 0 {
+		if current+1 < len(flow.Steps) {
+			return current + 1
+		}
+		return -1
+	}
+
+	roll := r.Float64()
+	for _, next := range step.Next {
+		if roll < next.Probability {
+			for i, candidate := range flow.Steps {
+				if candidate.Name == next.Step {
+					return i
+				}
+			}
+		}
+		roll -= next.Probability
+	}
+
+	return -1
+}
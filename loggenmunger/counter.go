@@ -0,0 +1,169 @@
+package loggenmunger
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// TokenScope identifies where a line came from, so stateful tokens like
+// counters can keep separate values per line, per source file, or globally.
+// Lines that are part of a flow also carry the flow instance's variables.
+type TokenScope struct {
+	LineID     string
+	SourceFile string
+	Vars       map[string]string
+}
+
+// counters holds the next value of every counter, keyed by scope and name
+var counters = struct {
+	sync.Mutex
+	m map[string]int64
+}{m: make(map[string]int64)}
+
+// counterOptions are the settings parsed out of a counter or sequence token
+type counterOptions struct {
+	name    string
+	start   int64
+	step    int64
+	wrap    int64
+	hasWrap bool
+	pad     int
+	scope   string
+}
+
+// getCounterValue handles $[counter||key=value||...] tokens, returning the
+// next value in the sequence. Valid keys are name, start, step, wrap, pad and
+// scope. Scope is one of line (default), file or global.
+func getCounterValue(tokenString string, itemList []string, scope TokenScope) (string, error) {
+	opts := counterOptions{step: 1, scope: "line"}
+
+	for _, item := range itemList[1:] {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return "", errors.New("Counter options must be of the form key=value: " + item)
+		}
+
+		var err error
+		switch kv[0] {
+		case "name":
+			opts.name = kv[1]
+		case "start":
+			opts.start, err = strconv.ParseInt(kv[1], 10, 64)
+		case "step":
+			opts.step, err = strconv.ParseInt(kv[1], 10, 64)
+		case "wrap":
+			opts.wrap, err = strconv.ParseInt(kv[1], 10, 64)
+			opts.hasWrap = true
+		case "pad":
+			opts.pad, err = strconv.Atoi(kv[1])
+		case "scope":
+			opts.scope = kv[1]
+		default:
+			return "", errors.New("Unknown counter option: " + kv[0])
+		}
+		if err != nil {
+			return "", errors.New("Counter option " + kv[0] + " must be an integer: " + kv[1])
+		}
+	}
+
+	if opts.step == 0 {
+		return "", errors.New("Counter step cannot be 0")
+	}
+	if opts.hasWrap && ((opts.step > 0 && opts.wrap < opts.start) || (opts.step < 0 && opts.wrap > opts.start)) {
+		return "", errors.New("Counter wrap must be reachable from start in the direction of step")
+	}
+
+	// Unnamed counters are identified by the token itself
+	if opts.name == "" {
+		opts.name = tokenString
+	}
+
+	key, err := counterKey(opts.scope, opts.name, scope)
+	if err != nil {
+		return "", err
+	}
+
+	value := nextCounterValue(key, opts)
+
+	log.WithFields(log.Fields{
+		"key":   key,
+		"value": value,
+	}).Debug("Incremented counter")
+
+	return fmt.Sprintf("%0*d", opts.pad, value), nil
+}
+
+// getSequenceValue handles $[sequence||a||b||c] tokens, cycling through the
+// items in order. Items of the form name=... or scope=... set options instead.
+func getSequenceValue(tokenString string, itemList []string, scope TokenScope) (string, error) {
+	opts := counterOptions{step: 1, scope: "line"}
+
+	var items []string
+	for _, item := range itemList[1:] {
+		switch {
+		case strings.HasPrefix(item, "name="):
+			opts.name = strings.TrimPrefix(item, "name=")
+		case strings.HasPrefix(item, "scope="):
+			opts.scope = strings.TrimPrefix(item, "scope=")
+		default:
+			items = append(items, item)
+		}
+	}
+
+	if len(items) == 0 {
+		return "", errors.New("Sequence tokens need at least one item: " + tokenString)
+	}
+
+	if opts.name == "" {
+		opts.name = tokenString
+	}
+	opts.wrap = int64(len(items) - 1)
+	opts.hasWrap = true
+
+	key, err := counterKey(opts.scope, "sequence:"+opts.name, scope)
+	if err != nil {
+		return "", err
+	}
+
+	// Named sequences can be shared by tokens with different item counts
+	return items[nextCounterValue(key, opts)%int64(len(items))], nil
+}
+
+// counterKey builds the lookup key for a counter based on its scope
+func counterKey(scopeName string, name string, scope TokenScope) (string, error) {
+	switch scopeName {
+	case "line":
+		return "line:" + scope.LineID + ":" + name, nil
+	case "file":
+		return "file:" + scope.SourceFile + ":" + name, nil
+	case "global":
+		return "global:" + name, nil
+	}
+
+	return "", errors.New("Counter scope must be one of line, file, or global: " + scopeName)
+}
+
+// nextCounterValue returns the current value of the counter and advances it,
+// wrapping back to start if it passes the wrap value
+func nextCounterValue(key string, opts counterOptions) int64 {
+	counters.Lock()
+	defer counters.Unlock()
+
+	value, ok := counters.m[key]
+	if !ok {
+		value = opts.start
+	}
+
+	next := value + opts.step
+	if opts.hasWrap && ((opts.step > 0 && next > opts.wrap) || (opts.step < 0 && next < opts.wrap)) {
+		next = opts.start
+	}
+	counters.m[key] = next
+
+	return value
+}
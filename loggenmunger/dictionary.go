@@ -0,0 +1,191 @@
+package loggenmunger
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Dictionary is a named list of values loaded from a word list file, with an
+// optional weight per value
+type Dictionary struct {
+	Name      string
+	Values    []string
+	cumWeight []float64
+}
+
+// DictionaryMetaData stores the configs around dictionary files
+type DictionaryMetaData struct {
+	Name         string `json:"Name"`
+	Path         string `json:"Path"`
+	Column       string `json:"Column"`
+	WeightColumn string `json:"WeightColumn"`
+}
+
+var dictionaries = struct {
+	sync.RWMutex
+	m map[string]*Dictionary
+}{m: make(map[string]*Dictionary)}
+
+// LoadDictionary reads in a word list file and registers it under its name so
+// that any line can use it in a $[dict||name] token. Files ending in .csv are
+// read as CSV with a header row, and the Column and WeightColumn headers pick
+// out the values and weights. All other files are one value per line.
+func LoadDictionary(meta DictionaryMetaData) error {
+	log.WithFields(log.Fields{
+		"name": meta.Name,
+		"path": meta.Path,
+	}).Info("Loading dictionary file")
+
+	file, err := os.Open(meta.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var dict *Dictionary
+	if strings.ToLower(filepath.Ext(meta.Path)) == ".csv" {
+		dict, err = readCSVDictionary(file, meta)
+	} else {
+		dict, err = readTextDictionary(file, meta)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(dict.Values) == 0 {
+		return errors.New("Dictionary file has no values: " + meta.Path)
+	}
+
+	log.WithFields(log.Fields{
+		"name":  meta.Name,
+		"count": len(dict.Values),
+	}).Debug("Finished loading dictionary")
+
+	dictionaries.Lock()
+	dictionaries.m[meta.Name] = dict
+	dictionaries.Unlock()
+
+	return nil
+}
+
+// readTextDictionary treats every non-blank line of the file as a value
+func readTextDictionary(r io.Reader, meta DictionaryMetaData) (*Dictionary, error) {
+	if meta.WeightColumn != "" {
+		return nil, errors.New("WeightColumn is only supported for CSV dictionary files")
+	}
+
+	dict := &Dictionary{Name: meta.Name}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		value := strings.TrimSpace(scanner.Text())
+		if value == "" {
+			continue
+		}
+		dict.Values = append(dict.Values, value)
+	}
+
+	return dict, scanner.Err()
+}
+
+// readCSVDictionary pulls the value and weight columns out of a CSV file,
+// defaulting to the first column if none is named
+func readCSVDictionary(r io.Reader, meta DictionaryMetaData) (*Dictionary, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, errors.New("Couldn't read the header row of CSV dictionary " + meta.Path + ": " + err.Error())
+	}
+
+	valueIndex := 0
+	weightIndex := -1
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		if meta.Column != "" && name == meta.Column {
+			valueIndex = i
+		}
+		if meta.WeightColumn != "" && name == meta.WeightColumn {
+			weightIndex = i
+		}
+	}
+	if meta.Column != "" && strings.TrimSpace(header[valueIndex]) != meta.Column {
+		return nil, errors.New("Column " + meta.Column + " not found in CSV dictionary " + meta.Path)
+	}
+	if meta.WeightColumn != "" && weightIndex == -1 {
+		return nil, errors.New("WeightColumn " + meta.WeightColumn + " not found in CSV dictionary " + meta.Path)
+	}
+
+	dict := &Dictionary{Name: meta.Name}
+	var total float64
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if valueIndex >= len(record) || strings.TrimSpace(record[valueIndex]) == "" {
+			continue
+		}
+
+		if weightIndex != -1 {
+			if weightIndex >= len(record) {
+				return nil, errors.New("Missing weight for value " + record[valueIndex] + " in CSV dictionary " + meta.Path)
+			}
+			weight, err := strconv.ParseFloat(strings.TrimSpace(record[weightIndex]), 64)
+			if err != nil || weight < 0 {
+				return nil, errors.New("Weight must be a non-negative number for value " + record[valueIndex] + " in CSV dictionary " + meta.Path)
+			}
+			total += weight
+			dict.cumWeight = append(dict.cumWeight, total)
+		}
+
+		dict.Values = append(dict.Values, record[valueIndex])
+	}
+
+	if weightIndex != -1 && len(dict.Values) > 0 && total == 0 {
+		return nil, errors.New("Weights in CSV dictionary " + meta.Path + " must not all be zero")
+	}
+
+	return dict, nil
+}
+
+// Pick returns one value from the dictionary, honoring weights if present
+func (d *Dictionary) Pick() string {
+	if d.cumWeight == nil {
+		return d.Values[rand.Intn(len(d.Values))]
+	}
+
+	target := rand.Float64() * d.cumWeight[len(d.cumWeight)-1]
+	i := sort.Search(len(d.cumWeight), func(i int) bool { return d.cumWeight[i] > target })
+	if i == len(d.cumWeight) {
+		i--
+	}
+	return d.Values[i]
+}
+
+// getDictionaryValue picks a value from a loaded dictionary by name
+func getDictionaryValue(name string) (string, error) {
+	dictionaries.RLock()
+	dict, ok := dictionaries.m[name]
+	dictionaries.RUnlock()
+
+	if !ok {
+		return "", errors.New("No dictionary loaded with the name: " + name)
+	}
+
+	return dict.Pick(), nil
+}
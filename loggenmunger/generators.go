@@ -0,0 +1,60 @@
+package loggenmunger
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+)
+
+// randomUUID returns a random (version 4) UUID
+func randomUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// randomIPv4 returns a random IPv4 address, inside the given CIDR block if
+// there is one
+func randomIPv4(cidr string) (string, error) {
+	if cidr == "" {
+		return fmt.Sprintf("%d.%d.%d.%d", rand.Intn(223)+1, rand.Intn(256), rand.Intn(256), rand.Intn(254)+1), nil
+	}
+
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", err
+	}
+	base := network.IP.To4()
+	if base == nil {
+		return "", errors.New("Only IPv4 CIDR blocks are supported: " + cidr)
+	}
+
+	ones, bits := network.Mask.Size()
+	hostBits := uint(bits - ones)
+	ip := binary.BigEndian.Uint32(base)
+	if hostBits > 0 {
+		ip |= uint32(rand.Int63n(int64(1) << hostBits))
+	}
+
+	out := make(net.IP, 4)
+	binary.BigEndian.PutUint32(out, ip)
+	return out.String(), nil
+}
+
+// randomMAC returns a random MAC address
+func randomMAC() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return net.HardwareAddr(b).String()
+}
+
+// randomHex returns n random lowercase hex digits
+func randomHex(n int) string {
+	b := make([]byte, (n+1)/2)
+	rand.Read(b)
+	return fmt.Sprintf("%x", b)[:n]
+}
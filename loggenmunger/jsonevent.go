@@ -0,0 +1,297 @@
+package loggenmunger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// FieldSpec describes how to generate one field of a JSON event
+type FieldSpec struct {
+	Name        string     `json:"-"`
+	Type        string     `json:"Type"`
+	Value       string     `json:"Value"`
+	Min         float64    `json:"Min"`
+	Max         float64    `json:"Max"`
+	Precision   int        `json:"Precision"`
+	Format      string     `json:"Format"`
+	Offset      string     `json:"Offset"`
+	Probability *float64   `json:"Probability"`
+	Fields      FieldList  `json:"Fields"`
+	Items       *FieldSpec `json:"Items"`
+	MinItems    int        `json:"MinItems"`
+	MaxItems    int        `json:"MaxItems"`
+}
+
+// FieldList is an ordered list of fields, read from a JSON object so that
+// the generated events keep the same key order as the data file
+type FieldList []FieldSpec
+
+// UnmarshalJSON reads the fields of an object in the order they're written
+func (f *FieldList) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		*f = nil
+		return nil
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '{' {
+		return errors.New("Fields must be a JSON object of field name to field spec")
+	}
+
+	*f = nil
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		name := token.(string)
+
+		var spec FieldSpec
+		if err := decoder.Decode(&spec); err != nil {
+			return errors.New("Field " + name + ": " + err.Error())
+		}
+		spec.Name = name
+		*f = append(*f, spec)
+	}
+
+	_, err = decoder.Token()
+	return err
+}
+
+// ReplaceFieldValues returns a copy of a field schema with old replaced by
+// new in every field's Value, including nested objects and array items. The
+// original schema is left alone, since it's shared by every send of a line.
+func ReplaceFieldValues(fields FieldList, old, new string) FieldList {
+	if fields == nil {
+		return nil
+	}
+
+	replaced := make(FieldList, len(fields))
+	for i, field := range fields {
+		field.Value = strings.Replace(field.Value, old, new, -1)
+		field.Fields = ReplaceFieldValues(field.Fields, old, new)
+		if field.Items != nil {
+			items := ReplaceFieldValues(FieldList{*field.Items}, old, new)[0]
+			field.Items = &items
+		}
+		replaced[i] = field
+	}
+	return replaced
+}
+
+// ValidateFields checks a field schema for unknown types and impossible
+// settings, so that mistakes are caught when the data file is loaded
+func ValidateFields(fields FieldList) error {
+	if len(fields) == 0 {
+		return errors.New("Fields must contain at least one field")
+	}
+
+	for _, field := range fields {
+		if err := validateField(field); err != nil {
+			return errors.New("Field " + field.Name + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+func validateField(field FieldSpec) error {
+	if field.Probability != nil && (*field.Probability < 0 || *field.Probability > 1) {
+		return errors.New("Probability must be between 0 and 1")
+	}
+
+	if err := ValidateTokens(field.Value); err != nil {
+		return err
+	}
+
+	switch field.Type {
+	case "string", "bool", "null":
+	case "int", "float":
+		if field.Value == "" && field.Max < field.Min {
+			return errors.New("Max must not be less than Min")
+		}
+	case "timestamp":
+		format := field.Format
+		if format == "" {
+			format = "RFC3339"
+		}
+		if err := ValidateTimeFormat(format); err != nil {
+			return err
+		}
+		if field.Offset != "" {
+			if _, err := parseOffset(field.Offset); err != nil {
+				return err
+			}
+		}
+	case "object":
+		return ValidateFields(field.Fields)
+	case "array":
+		if field.Items == nil {
+			return errors.New("Arrays need an Items field spec")
+		}
+		if field.MinItems < 0 || field.MaxItems < field.MinItems {
+			return errors.New("MinItems must be non-negative and no more than MaxItems")
+		}
+		return validateField(*field.Items)
+	default:
+		return errors.New("Type must be in (string, int, float, bool, null, timestamp, object, array): " + field.Type)
+	}
+
+	return nil
+}
+
+// RenderJSONEvent generates one JSON event from a field schema. String
+// values may contain the usual $[...] tokens.
+func RenderJSONEvent(fields FieldList, timeformat string, scope TokenScope) string {
+	return renderJSONEvent(fields, timeformat, scope, time.Now())
+}
+
+// renderJSONEvent generates a JSON event as of the instant now
+func renderJSONEvent(fields FieldList, timeformat string, scope TokenScope, now time.Time) string {
+	log.WithFields(log.Fields{
+		"fields": len(fields),
+	}).Debug("Starting JSON event rendering")
+
+	var out bytes.Buffer
+	err := writeObject(&out, fields, timeformat, scope, now)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error_msg": err,
+		}).Warn("Couldn't render the JSON event. Using default JSON_ERROR")
+		return "JSON_ERROR"
+	}
+
+	log.Debug("JSON event rendering complete: ", "newString - ", out.String())
+
+	return out.String()
+}
+
+// writeObject writes out the fields of an object, skipping optional fields
+// that lose their roll of the dice
+func writeObject(out *bytes.Buffer, fields FieldList, timeformat string, scope TokenScope, now time.Time) error {
+	out.WriteByte('{')
+	first := true
+	for _, field := range fields {
+		if field.Probability != nil && rand.Float64() >= *field.Probability {
+			continue
+		}
+
+		if !first {
+			out.WriteByte(',')
+		}
+		first = false
+
+		name, _ := json.Marshal(field.Name)
+		out.Write(name)
+		out.WriteByte(':')
+		if err := writeValue(out, field, timeformat, scope, now); err != nil {
+			return errors.New("Field " + field.Name + ": " + err.Error())
+		}
+	}
+	out.WriteByte('}')
+	return nil
+}
+
+// writeValue writes out a single generated value
+func writeValue(out *bytes.Buffer, field FieldSpec, timeformat string, scope TokenScope, now time.Time) error {
+	switch field.Type {
+	case "string":
+		value, _ := json.Marshal(RandomizeString(field.Value, timeformat, scope))
+		out.Write(value)
+	case "int":
+		if field.Value != "" {
+			value, err := strconv.ParseInt(strings.TrimSpace(RandomizeString(field.Value, timeformat, scope)), 10, 64)
+			if err != nil {
+				return err
+			}
+			out.WriteString(strconv.FormatInt(value, 10))
+			return nil
+		}
+		low, high := int64(field.Min), int64(field.Max)
+		if high < low {
+			return errors.New("Max must not be less than Min")
+		}
+		out.WriteString(strconv.FormatInt(low+rand.Int63n(high-low+1), 10))
+	case "float":
+		value := field.Min + rand.Float64()*(field.Max-field.Min)
+		if field.Value != "" {
+			var err error
+			value, err = strconv.ParseFloat(strings.TrimSpace(RandomizeString(field.Value, timeformat, scope)), 64)
+			if err != nil {
+				return err
+			}
+		}
+		precision := -1
+		if field.Precision > 0 {
+			precision = field.Precision
+		}
+		out.WriteString(strconv.FormatFloat(value, 'f', precision, 64))
+	case "bool":
+		value := rand.Intn(2) == 1
+		if field.Value != "" {
+			var err error
+			value, err = strconv.ParseBool(strings.TrimSpace(RandomizeString(field.Value, timeformat, scope)))
+			if err != nil {
+				return err
+			}
+		}
+		out.WriteString(strconv.FormatBool(value))
+	case "null":
+		out.WriteString("null")
+	case "timestamp":
+		format := field.Format
+		if format == "" {
+			format = "RFC3339"
+		}
+		t := now
+		if field.Offset != "" {
+			offset, err := parseOffset(field.Offset)
+			if err != nil {
+				return err
+			}
+			t = t.Add(offset)
+		}
+		formatted, err := formatTimestamp(t, format)
+		if err != nil {
+			return err
+		}
+		// Epoch timestamps are written as numbers, everything else as strings
+		if strings.HasPrefix(format, "epoch") {
+			out.WriteString(formatted)
+		} else {
+			value, _ := json.Marshal(formatted)
+			out.Write(value)
+		}
+	case "object":
+		return writeObject(out, field.Fields, timeformat, scope, now)
+	case "array":
+		count := field.MinItems
+		if field.MaxItems > field.MinItems {
+			count += rand.Intn(field.MaxItems - field.MinItems + 1)
+		}
+		out.WriteByte('[')
+		for i := 0; i < count; i++ {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			if err := writeValue(out, *field.Items, timeformat, scope, now); err != nil {
+				return err
+			}
+		}
+		out.WriteByte(']')
+	default:
+		return errors.New("Unknown field type: " + field.Type)
+	}
+
+	return nil
+}
@@ -11,44 +11,49 @@ import (
 	log "github.com/Sirupsen/logrus"
 )
 
+// tokenRegex finds the random tokens, as well as the $$[ escape for a literal $[.
+// Tokens may contain [...] so that regex tokens can use character classes,
+// including POSIX classes like [[:alpha:]], and a backslash escapes the
+// character after it, so \] doesn't end the token.
+var tokenRegex = regexp.MustCompile(`\$\$\[|\$\[(?:\\.|[^\[\]\\]|\[(?:\[:[a-z]+:\]|\\.|[^\]\\])*\])+\]`)
+
 // RandomizeString takes a string, looks for the random tokens
-// (int, string, and timestamp), and replaces them
-func RandomizeString(text string, timeformat string) string {
+// (int, string, timestamp, dictionary, counter, sequence, regex and variable), and replaces them.
+// The scope identifies the line for stateful tokens like counters.
+func RandomizeString(text string, timeformat string, scope TokenScope) string {
 	log.WithFields(log.Fields{
 		"text":       text,
 		"timeformat": timeformat,
 	}).Debug("Starting String Randomization")
 
-	// Bail if we can't get any randomizers
-	goodstring, err := regexp.MatchString(`\$\[[^\]]+\]`, text)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"error_msg": err,
-			"text":      text,
-			"regex":     `\$\[[^\]]+\]`,
-		}).Error("Something broke on parsing the text string with a regular expression")
-	}
-
 	//Return original string if 0 randomizers
-	if !goodstring {
+	if !tokenRegex.MatchString(text) {
 		log.Debug("Found no random tokens, returning the original string")
 		return text
 	}
 
 	// Find all randomizing tokens
-	re := regexp.MustCompile(`\$\[[^\]]+\]`)
-	randos := re.FindAllString(text, -1)
+	randos := tokenRegex.FindAllString(text, -1)
 	log.WithFields(log.Fields{
 		"num":          len(randos),
 		"randomTokens": randos,
 	}).Debug("Found random tokens")
 
+	// All timestamps in the line are relative to the same instant
+	now := time.Now()
+
 	// Create a list of new strings to be inserted where the tokens were
 	var newstrings []string
 
 	// Append the properly randomized values to the newstrings slice
 	for _, rando := range randos {
-		value, err := getOneToken(rando, timeformat)
+		// Escaped tokens are passed through literally
+		if rando == "$$[" {
+			newstrings = append(newstrings, "$[")
+			continue
+		}
+
+		value, err := getOneToken(rando, timeformat, scope, now)
 		if err != nil {
 			log.WithFields(log.Fields{
 				"error":        err,
@@ -62,7 +67,7 @@ func RandomizeString(text string, timeformat string) string {
 
 	// We can use the same regex that found the tokens to split up the original string
 	// That gives us clear insertion points for our selected tokens
-	nonRandomStrings := re.Split(text, -1)
+	nonRandomStrings := tokenRegex.Split(text, -1)
 	var newLogLine []string
 
 	for i := 0; i < len(nonRandomStrings); i++ {
@@ -77,11 +82,24 @@ func RandomizeString(text string, timeformat string) string {
 	return strings.Join(newLogLine, "")
 }
 
-func getOneToken(tokenString string, timeformat string) (string, error) {
-	replacer := strings.NewReplacer("$[", "", "]", "")
+// getVariableValue looks up a flow variable for $[var||name] tokens
+func getVariableValue(name string, scope TokenScope) (string, error) {
+	value, ok := scope.Vars[name]
+	if !ok {
+		return "", errors.New("No variable set with the name: " + name)
+	}
+	return value, nil
+}
+
+// EscapeTokens escapes every $[ in the text, so that RandomizeString will
+// leave it exactly as it is
+func EscapeTokens(text string) string {
+	return strings.Replace(text, "$[", "$$[", -1)
+}
 
+func getOneToken(tokenString string, timeformat string, scope TokenScope, now time.Time) (string, error) {
 	// Take off the leading and trailing formatting
-	tempstring := replacer.Replace(tokenString)
+	tempstring := strings.TrimSuffix(strings.TrimPrefix(tokenString, "$["), "]")
 	log.WithFields(log.Fields{
 		"tempstring": tempstring,
 	}).Debug("Removing the formatting from the item list")
@@ -94,10 +112,16 @@ func getOneToken(tokenString string, timeformat string) (string, error) {
 	}).Debug("Splitting the random tokens up")
 
 	// Numeric ranges will only have two items for an upper and lower bound,
-	// timestamps have "time" and "stamp", all the rest are string groups
+	// timestamps have "time" and "stamp", dictionaries have "dict" and a name,
+	// variables have "var" and a name, counters, sequences and regexes lead
+	// with their keyword, all the rest are string groups
 	var randType string
 	num0, err := strconv.Atoi(string(itemList[0]))
-	num1, err2 := strconv.Atoi(string(itemList[1]))
+	var num1 int
+	err2 := errors.New("No second entry in the token")
+	if len(itemList) > 1 {
+		num1, err2 = strconv.Atoi(string(itemList[1]))
+	}
 	log.WithFields(log.Fields{
 		"num":       num0,
 		"error_msg": err,
@@ -111,8 +135,18 @@ func getOneToken(tokenString string, timeformat string) (string, error) {
 	switch {
 	case len(itemList) == 2 && err == nil && err2 == nil:
 		randType = "Number"
-	case itemList[0] == "time" && itemList[1] == "stamp":
+	case len(itemList) > 1 && itemList[0] == "time" && itemList[1] == "stamp":
 		randType = "Timestamp"
+	case len(itemList) == 2 && itemList[0] == "dict":
+		randType = "Dictionary"
+	case itemList[0] == "counter":
+		randType = "Counter"
+	case itemList[0] == "sequence":
+		randType = "Sequence"
+	case len(itemList) > 1 && itemList[0] == "regex":
+		randType = "Regex"
+	case len(itemList) == 2 && itemList[0] == "var":
+		randType = "Variable"
 	default:
 		randType = "Category"
 	}
@@ -133,50 +167,181 @@ func getOneToken(tokenString string, timeformat string) (string, error) {
 		log.Debug("Random number adjusted to range and string converted: ", "rand - ", strconv.Itoa(tempnum+num0))
 		return strconv.Itoa(tempnum + num0), nil
 	case "Timestamp":
-		t := time.Now()
-		timeformatted, err := formatTimestamp(t, timeformat)
+		t, tokenformat, err := getTimestampOptions(itemList[2:], timeformat, now)
+		if err != nil {
+			return "", err
+		}
+		timeformatted, err := formatTimestamp(t, tokenformat)
 		if err != nil {
 			log.WithFields(log.Fields{
 				"error_msg": err,
 			}).Error("Formatting the timestamp failed. Please make sure the timestamp format corresponds to the date of 01/02 03:04:05PM '06 -0700. Replacing timestamp with TIME_FORMAT_ERROR.")
 		}
 		return timeformatted, err
+	case "Dictionary":
+		return getDictionaryValue(itemList[1])
+	case "Counter":
+		return getCounterValue(tokenString, itemList, scope)
+	case "Sequence":
+		return getSequenceValue(tokenString, itemList, scope)
+	case "Regex":
+		// The pattern itself may contain ||, so put it back together
+		return getRegexValue(strings.Join(itemList[1:], "||"))
+	case "Variable":
+		return getVariableValue(itemList[1], scope)
 	}
 
 	// Failure case. Should never happen.
 	return "", errors.New("Unknown error trying to get a token from the list: " + tokenString)
 }
 
+// ValidateTokens checks the tokens in a line's text that can be checked
+// ahead of time, so that mistakes are caught when the data file is loaded
+func ValidateTokens(text string) error {
+	for _, token := range tokenRegex.FindAllString(text, -1) {
+		if token == "$$[" {
+			continue
+		}
+
+		itemList := strings.Split(strings.TrimSuffix(strings.TrimPrefix(token, "$["), "]"), "||")
+		switch {
+		case itemList[0] == "regex" && len(itemList) > 1:
+			if _, err := getRegexGenerator(strings.Join(itemList[1:], "||")); err != nil {
+				return errors.New(err.Error() + " in token " + token)
+			}
+		case len(itemList) > 1 && itemList[0] == "time" && itemList[1] == "stamp":
+			if err := validateTimestampOptions(itemList[2:]); err != nil {
+				return errors.New(err.Error() + " in token " + token)
+			}
+		}
+	}
+	return nil
+}
+
+// validateTimestampOptions checks the format= and offset= items of a
+// timestamp token. A token without a format uses the line's, which is
+// checked on its own.
+func validateTimestampOptions(options []string) error {
+	for _, option := range options {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			return errors.New("Timestamp options must be of the form key=value: " + option)
+		}
+
+		switch kv[0] {
+		case "format":
+			if err := ValidateTimeFormat(kv[1]); err != nil {
+				return err
+			}
+		case "offset":
+			if _, err := parseOffset(kv[1]); err != nil {
+				return err
+			}
+		default:
+			return errors.New("Unknown timestamp option: " + kv[0])
+		}
+	}
+	return nil
+}
+
+// getTimestampOptions applies the optional format= and offset= items of a
+// timestamp token. Offsets are Go durations like -500ms, or a range like
+// -500ms..0s to pick a random offset in between.
+func getTimestampOptions(options []string, timeformat string, now time.Time) (time.Time, string, error) {
+	t := now
+	for _, option := range options {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			return t, timeformat, errors.New("Timestamp options must be of the form key=value: " + option)
+		}
+
+		switch kv[0] {
+		case "format":
+			timeformat = kv[1]
+		case "offset":
+			offset, err := parseOffset(kv[1])
+			if err != nil {
+				return t, timeformat, err
+			}
+			t = t.Add(offset)
+		default:
+			return t, timeformat, errors.New("Unknown timestamp option: " + kv[0])
+		}
+	}
+
+	return t, timeformat, nil
+}
+
+// parseOffset reads a single duration, or picks a random one out of a min..max range
+func parseOffset(offset string) (time.Duration, error) {
+	bounds := strings.SplitN(offset, "..", 2)
+
+	low, err := time.ParseDuration(bounds[0])
+	if err != nil {
+		return 0, errors.New("Timestamp offset is not a valid duration: " + bounds[0])
+	}
+	if len(bounds) == 1 {
+		return low, nil
+	}
+
+	high, err := time.ParseDuration(bounds[1])
+	if err != nil {
+		return 0, errors.New("Timestamp offset is not a valid duration: " + bounds[1])
+	}
+	if high < low {
+		return 0, errors.New("Timestamp offset range must go from low to high: " + offset)
+	}
+	if high == low {
+		return low, nil
+	}
+
+	return low + time.Duration(rand.Int63n(int64(high-low)+1)), nil
+}
+
+// formatTimestamp renders a time with any of the supported timestamp formats:
+// epoch, epochmilli, epochnano, a named preset, a strftime format, a Java
+// pattern, or a Go reference layout
 func formatTimestamp(t time.Time, timeformat string) (string, error) {
 	log.WithFields(log.Fields{
 		"now": t,
 	}).Debug("Current time: ")
 
+	// Named presets are just shorthand for a Go layout
+	if layout, ok := timestampPresets[timeformat]; ok {
+		timeformat = layout
+	}
+
 	var timeformatted string
-	switch timeformat {
-	case "epoch":
+	var err error
+	switch {
+	case timeformat == "epoch":
 		timeformatted = strconv.FormatInt(t.Unix(), 10)
-	case "epochmilli":
+	case timeformat == "epochmilli":
 		timeformatted = strconv.FormatInt(t.UnixNano()/1000000, 10)
-	case "epochnano":
+	case timeformat == "epochnano":
 		timeformatted = strconv.FormatInt(t.UnixNano(), 10)
+	case strings.Contains(timeformat, "%"):
+		timeformatted, err = formatStrftime(t, timeformat)
+	case isJavaFormat(timeformat):
+		timeformatted, err = formatJava(t, timeformat)
 	default:
 		timeformatted = t.Format(timeformat)
-	}
-
-	log.WithFields(log.Fields{
-		"FormattedTime": timeformatted,
-	}).Debug("Formatted time: ")
 
-	if timeformat != "epoch" && timeformat != "epochmilli" && timeformat != "epochnano" {
 		// The only way I could think of to verify a time format string was to
 		// parse the formatted date back to a time object and check for errors
 		// Wierdly, it will still try to give you a time if the format is bad.
-		_, err := time.Parse(timeformat, timeformatted)
-		if err != nil || timeformatted == timeformat {
-			return "TIME_FORMAT_ERROR", err
+		_, err = time.Parse(timeformat, timeformatted)
+		if err == nil && timeformatted == timeformat {
+			return "TIME_FORMAT_ERROR", nil
 		}
+	}
 
+	log.WithFields(log.Fields{
+		"FormattedTime": timeformatted,
+	}).Debug("Formatted time: ")
+
+	if err != nil {
+		return "TIME_FORMAT_ERROR", err
 	}
 
 	return timeformatted, nil
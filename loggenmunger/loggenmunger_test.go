@@ -1,6 +1,10 @@
 package loggenmunger
 
 import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 )
@@ -13,7 +17,7 @@ func TestGetOneToken(t *testing.T) {
 		{"$[Post||Thing||Stuff]", "Jan 02 15:04:05"},
 	}
 	for _, c := range postitiveCases {
-		output, err := getOneToken(c.tokenString, c.timeFormat)
+		output, err := getOneToken(c.tokenString, c.timeFormat, TokenScope{}, time.Now())
 		if err != nil || output == "" {
 			t.Errorf("Failed positive case: {%q,%q} >> %q - %q", c.tokenString, c.timeFormat, output, err)
 		}
@@ -26,7 +30,7 @@ func TestGetOneToken(t *testing.T) {
 		{"$[time||stamp]", "Feb 01 12:02:02"},
 	}
 	for _, c := range negativeCases {
-		output, err := getOneToken(c.tokenString, c.timeFormat)
+		output, err := getOneToken(c.tokenString, c.timeFormat, TokenScope{}, time.Now())
 		if err != nil && output != "TIME_FORMAT_ERROR" {
 			t.Errorf("Failed negative case: {%q,%q} >> %q - %q", c.tokenString, c.timeFormat, output, err)
 		}
@@ -42,6 +46,9 @@ func TestFormatTimestamp(t *testing.T) {
 	referenceTime1, _ := time.Parse(time.RFC3339, "2016-01-01T00:00:00+00:00")
 	referenceTime2, _ := time.Parse(time.RFC3339, "2016-02-12T05:42:21+00:00")
 	referenceTime3, _ := time.Parse(time.RFC3339, "2015-12-29T22:08:41+00:00")
+	referenceTime4, _ := time.Parse(time.RFC3339, "2014-12-29T12:00:00+00:00")
+	referenceTime5, _ := time.Parse(time.RFC3339, "2015-12-26T12:00:00+00:00")
+	referenceTime6, _ := time.Parse(time.RFC3339, "2015-12-27T12:00:00+00:00")
 	cases := []FormatTimestampCases{
 		// Good Formatting Cases
 		{referenceTime1, "epoch", "1451606400"},
@@ -51,7 +58,35 @@ func TestFormatTimestamp(t *testing.T) {
 		{referenceTime1, "2006-01-02 15:04:05", "2016-01-01 00:00:00"},
 		{referenceTime2, "Jan 02 15:04:05", "Feb 12 05:42:21"},
 		{referenceTime3, "Jan 02 15:04:05", "Dec 29 22:08:41"},
+		// Preset Cases
+		{referenceTime2, "RFC3339", "2016-02-12T05:42:21Z"},
+		{referenceTime2, "ISO8601", "2016-02-12T05:42:21.000Z"},
+		{referenceTime2, "syslog", "Feb 12 05:42:21"},
+		{referenceTime2, "apache", "12/Feb/2016:05:42:21 +0000"},
+		{referenceTime2, "W3C", "2016-02-12 05:42:21"},
+		// strftime Cases
+		{referenceTime2, "%Y-%m-%d %H:%M:%S", "2016-02-12 05:42:21"},
+		{referenceTime2, "%d/%b/%Y:%T %z", "12/Feb/2016:05:42:21 +0000"},
+		{referenceTime2, "%F 1%% at %L", "2016-02-12 1% at 000"},
+		{referenceTime2, "%s", "1455255741"},
+		// Java Cases
+		{referenceTime2, "yyyy-MM-dd HH:mm:ss.SSS", "2016-02-12 05:42:21.000"},
+		{referenceTime2, "dd/MMM/yy h:mm a", "12/Feb/16 5:42 AM"},
+		{referenceTime2, "yyyy-MM-dd'T'HH:mm:ssXXX", "2016-02-12T05:42:21Z"},
+		{referenceTime2, "java:EEE HH:mm", "Fri 05:42"},
+		{referenceTime2, "HH:mm:ss.SSS", "05:42:21.000"},
+		{referenceTime2, "MMM dd HH:mm:ss", "Feb 12 05:42:21"},
+		{referenceTime1, "yyyy-MM-dd", "2016-01-01"},
+		// Y is the US week year, so the week with January 1st in it is in the new year
+		{referenceTime1, "YYYY-MM-dd", "2016-01-01"},
+		{referenceTime4, "java:YY-MM-dd", "15-12-29"},
+		{referenceTime5, "YYYY-MM-dd", "2015-12-26"},
+		{referenceTime6, "YYYY-MM-dd", "2016-12-27"},
 		// Bad Formatting Cases
+		{referenceTime1, "%Y-%Q", "TIME_FORMAT_ERROR"},
+		{referenceTime1, "%Y-%", "TIME_FORMAT_ERROR"},
+		{referenceTime1, "yyyy-MM-dd'T", "TIME_FORMAT_ERROR"},
+		{referenceTime1, "yyyy-qq", "TIME_FORMAT_ERROR"},
 		{referenceTime1, "2008-01-02 17:02:01", "TIME_FORMAT_ERROR"},
 		{referenceTime1, "2004", "TIME_FORMAT_ERROR"},
 		{referenceTime1, "", "TIME_FORMAT_ERROR"},
@@ -64,3 +99,412 @@ func TestFormatTimestamp(t *testing.T) {
 		}
 	}
 }
+
+func TestLoadDictionary(t *testing.T) {
+	positiveCases := []DictionaryMetaData{
+		{Name: "usernames", Path: "../config/dictionary_examples/usernames.txt"},
+		{Name: "useragents", Path: "../config/dictionary_examples/useragents.csv", Column: "agent", WeightColumn: "weight"},
+	}
+	for _, c := range positiveCases {
+		err := LoadDictionary(c)
+		if err != nil {
+			t.Errorf("Failed positive case: %+v >> %q", c, err)
+			continue
+		}
+		output, err := getOneToken("$[dict||"+c.Name+"]", "Jan 02 15:04:05", TokenScope{}, time.Now())
+		if err != nil || output == "" || output == "dict" || output == c.Name {
+			t.Errorf("Failed token case: %+v >> %q - %q", c, output, err)
+		}
+	}
+
+	negativeCases := []DictionaryMetaData{
+		{Name: "missing", Path: "../config/dictionary_examples/missing.txt"},
+		{Name: "badcolumn", Path: "../config/dictionary_examples/useragents.csv", Column: "bogus"},
+		{Name: "badweight", Path: "../config/dictionary_examples/useragents.csv", WeightColumn: "bogus"},
+		{Name: "textweight", Path: "../config/dictionary_examples/usernames.txt", WeightColumn: "weight"},
+	}
+	for _, c := range negativeCases {
+		if err := LoadDictionary(c); err == nil {
+			t.Errorf("Failed negative case: %+v", c)
+		}
+	}
+
+	if output, err := getOneToken("$[dict||notloaded]", "Jan 02 15:04:05", TokenScope{}, time.Now()); err == nil {
+		t.Errorf("Failed unloaded dictionary case: %q", output)
+	}
+}
+
+func TestCounterTokens(t *testing.T) {
+	lineA := TokenScope{LineID: "a.data:0", SourceFile: "a.data"}
+	lineB := TokenScope{LineID: "a.data:1", SourceFile: "a.data"}
+	lineC := TokenScope{LineID: "c.data:0", SourceFile: "c.data"}
+
+	cases := []struct {
+		tokenString   string
+		scope         TokenScope
+		desiredOutput string
+	}{
+		// Per line counters start over for each line
+		{"$[counter||start=5]", lineA, "5"},
+		{"$[counter||start=5]", lineA, "6"},
+		{"$[counter||start=5]", lineB, "5"},
+		// Wrapping and padding
+		{"$[counter||step=2||wrap=4||pad=3]", lineA, "000"},
+		{"$[counter||step=2||wrap=4||pad=3]", lineA, "002"},
+		{"$[counter||step=2||wrap=4||pad=3]", lineA, "004"},
+		{"$[counter||step=2||wrap=4||pad=3]", lineA, "000"},
+		{"$[counter||start=3||step=-1||wrap=2]", lineA, "3"},
+		{"$[counter||start=3||step=-1||wrap=2]", lineA, "2"},
+		{"$[counter||start=3||step=-1||wrap=2]", lineA, "3"},
+		// File and global scopes are shared
+		{"$[counter||name=txn||scope=file]", lineA, "0"},
+		{"$[counter||name=txn||scope=file]", lineB, "1"},
+		{"$[counter||name=txn||scope=file]", lineC, "0"},
+		{"$[counter||name=txn||scope=global]", lineA, "0"},
+		{"$[counter||name=txn||scope=global]", lineC, "1"},
+		// Sequences cycle through their items
+		{"$[sequence||web01||web02||web03]", lineA, "web01"},
+		{"$[sequence||web01||web02||web03]", lineA, "web02"},
+		{"$[sequence||web01||web02||web03]", lineA, "web03"},
+		{"$[sequence||web01||web02||web03]", lineA, "web01"},
+		{"$[sequence||scope=global||x||y]", lineA, "x"},
+		{"$[sequence||scope=global||x||y]", lineB, "y"},
+	}
+	for _, c := range cases {
+		output, err := getOneToken(c.tokenString, "", c.scope, time.Now())
+		if err != nil || output != c.desiredOutput {
+			t.Errorf("Failed case: {%q,%+v,%q} >> %q - %q", c.tokenString, c.scope, c.desiredOutput, output, err)
+		}
+	}
+
+	negativeCases := []string{
+		"$[counter||step=0]",
+		"$[counter||start=bogus]",
+		"$[counter||bogus]",
+		"$[counter||color=blue]",
+		"$[counter||scope=bogus]",
+		"$[counter||start=10||wrap=5]",
+		"$[sequence||scope=global]",
+	}
+	for _, c := range negativeCases {
+		if output, err := getOneToken(c, "", lineA, time.Now()); err == nil {
+			t.Errorf("Failed negative case: %q >> %q", c, output)
+		}
+	}
+
+	// Concurrent rendering must never hand out the same value twice
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			output := RandomizeString("$[counter||name=concurrent||scope=global]", "", lineA)
+			mu.Lock()
+			defer mu.Unlock()
+			if seen[output] {
+				t.Errorf("Counter value handed out twice: %q", output)
+			}
+			seen[output] = true
+		}()
+	}
+	wg.Wait()
+}
+
+func TestTimestampTokens(t *testing.T) {
+	now, _ := time.Parse(time.RFC3339, "2016-02-12T05:42:21+00:00")
+	cases := []struct {
+		tokenString, timeFormat, desiredOutput string
+	}{
+		{"$[time||stamp]", "Jan 02 15:04:05", "Feb 12 05:42:21"},
+		{"$[time||stamp||format=2006-01-02T15:04:05]", "Jan 02 15:04:05", "2016-02-12T05:42:21"},
+		{"$[time||stamp||offset=-90s]", "Jan 02 15:04:05", "Feb 12 05:40:51"},
+		{"$[time||stamp||format=epoch||offset=1h]", "Jan 02 15:04:05", "1455259341"},
+		{"$[time||stamp||offset=2s..2s]", "Jan 02 15:04:05", "Feb 12 05:42:23"},
+	}
+	for _, c := range cases {
+		output, err := getOneToken(c.tokenString, c.timeFormat, TokenScope{}, now)
+		if err != nil || output != c.desiredOutput {
+			t.Errorf("Failed case: {%q,%q,%q} >> %q - %q", c.tokenString, c.timeFormat, c.desiredOutput, output, err)
+		}
+	}
+
+	// Random offsets stay inside their range
+	for i := 0; i < 20; i++ {
+		output, err := getOneToken("$[time||stamp||format=epochmilli||offset=-500ms..0s]", "", TokenScope{}, now)
+		millis, _ := strconv.ParseInt(output, 10, 64)
+		if err != nil || millis < 1455255741000-500 || millis > 1455255741000 {
+			t.Errorf("Failed random offset case >> %q - %q", output, err)
+		}
+	}
+
+	negativeCases := []string{
+		"$[time||stamp||offset=bogus]",
+		"$[time||stamp||offset=5s..1s]",
+		"$[time||stamp||color=blue]",
+		"$[time||stamp||format=bogus]",
+	}
+	for _, c := range negativeCases {
+		if output, err := getOneToken(c, "Jan 02 15:04:05", TokenScope{}, now); err == nil && output != "TIME_FORMAT_ERROR" {
+			t.Errorf("Failed negative case: %q >> %q", c, output)
+		}
+	}
+}
+
+func TestValidateTimeFormat(t *testing.T) {
+	for _, c := range []string{"epoch", "Jan 02 15:04:05", "RFC3339Nano", "%Y-%m-%d", "yyyy-MM-dd"} {
+		if err := ValidateTimeFormat(c); err != nil {
+			t.Errorf("Failed positive case: %q >> %q", c, err)
+		}
+	}
+	for _, c := range []string{"", "bogus", "2004", "%Q", "java:'literal'"} {
+		if err := ValidateTimeFormat(c); err == nil {
+			t.Errorf("Failed negative case: %q", c)
+		}
+	}
+}
+
+func TestFormatTime(t *testing.T) {
+	now, _ := time.Parse(time.RFC3339, "2016-01-02T15:04:05Z")
+	cases := []struct {
+		format, desiredOutput string
+	}{
+		{"yyyy.MM.dd", "2016.01.02"},
+		{"%Y-%m", "2016-01"},
+		{"2006.01.02.15", "2016.01.02.15"},
+		{"epoch", "1451747045"},
+	}
+	for _, c := range cases {
+		if output, err := FormatTime(now, c.format); err != nil || output != c.desiredOutput {
+			t.Errorf("Failed case: {%q,%q} >> %q", c.format, c.desiredOutput, output)
+		}
+	}
+	if _, err := FormatTime(now, "bogus"); err == nil {
+		t.Errorf("Failed negative case: %q", "bogus")
+	}
+}
+
+func TestFormatDatePattern(t *testing.T) {
+	now, _ := time.Parse(time.RFC3339, "2016-01-02T15:04:05Z")
+	cases := []struct {
+		pattern, desiredOutput string
+	}{
+		{"logs-%{+yyyy.MM.dd}", "logs-2016.01.02"},
+		{"app.log-%{+%Y%m%d}-%{+%H}", "app.log-20160102-15"},
+		{"no-dates", "no-dates"},
+	}
+	for _, c := range cases {
+		if output := FormatDatePattern(c.pattern, now); output != c.desiredOutput {
+			t.Errorf("Failed case: {%q,%q} >> %q", c.pattern, c.desiredOutput, output)
+		}
+	}
+	if err := ValidateDatePattern("logs-%{+bogus}"); err == nil {
+		t.Errorf("Failed negative case: %q", "logs-%{+bogus}")
+	}
+}
+
+func TestReplaceFieldValues(t *testing.T) {
+	var line struct {
+		Fields FieldList `json:"Fields"`
+	}
+	schema := `{"Fields": {
+		"latency": {"Type": "int", "Value": "$[100||200]"},
+		"request": {"Type": "object", "Fields": {"time": {"Type": "int", "Value": "$[100||200]"}}},
+		"retries": {"Type": "array", "MinItems": 1, "MaxItems": 1, "Items": {"Type": "int", "Value": "$[100||200]"}}
+	}}`
+	if err := json.Unmarshal([]byte(schema), &line); err != nil {
+		t.Fatalf("Couldn't unmarshal schema: %q", err)
+	}
+
+	replaced := ReplaceFieldValues(line.Fields, "$[100||200]", "$[900||901]")
+	output := RenderJSONEvent(replaced, "", TokenScope{})
+	if desiredOutput := `{"latency":900,"request":{"time":900},"retries":[900]}`; output != desiredOutput {
+		t.Errorf("Failed case: %q >> %q", desiredOutput, output)
+	}
+	if line.Fields[0].Value != "$[100||200]" || line.Fields[1].Fields[0].Value != "$[100||200]" || line.Fields[2].Items.Value != "$[100||200]" {
+		t.Errorf("Failed case: original schema was changed")
+	}
+}
+
+func TestEscapedTokens(t *testing.T) {
+	cases := []struct {
+		text, desiredOutput string
+	}{
+		{"price: $$[0||5]", "price: $[0||5]"},
+		{"$$[a]$$[b]", "$[a]$[b]"},
+		{"echo $$[ ${HOME} ]", "echo $[ ${HOME} ]"},
+		{"$$[$[sequence||x]]", "$[x]"},
+		{EscapeTokens("$.store[*] and $[0||5] and $$[1||2]"), "$.store[*] and $[0||5] and $$[1||2]"},
+	}
+	for _, c := range cases {
+		output := RandomizeString(c.text, "Jan 02 15:04:05", TokenScope{})
+		if output != c.desiredOutput {
+			t.Errorf("Failed case: {%q,%q} >> %q", c.text, c.desiredOutput, output)
+		}
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	scope := TokenScope{LineID: "template.data:0", SourceFile: "template.data"}
+	now, _ := time.Parse(time.RFC3339, "2016-01-02T15:04:05Z")
+	cases := []struct {
+		text, desiredOutput string
+	}{
+		{`plain text`, "plain text"},
+		{`{{if chance 1.0}}always{{end}}{{if chance 0.0}}never{{end}}`, "always"},
+		{`{{choice "only"}} {{sequence "a" "b"}}{{sequence "a" "b"}}`, "only ab"},
+		{`{{counter "start=7" "pad=3"}}`, "007"},
+		{`{{timestamp "format=2006" "offset=-8760h"}}`, "2015"},
+		{`{{timestamp "format=2006-01-02" "offset=-48h"}}`, "2015-12-31"},
+		{`{"msg":{{json "say \"hi\""}}}`, `{"msg":"say \"hi\""}`},
+		{`{{len uuid}} {{len (hex 5)}} {{ipv4 "10.1.2.3/32"}}`, "36 5 10.1.2.3"},
+		{`{{.LineID}}`, "template.data:0"},
+		// Errors
+		{`{{randInt 5 1}}`, "TEMPLATE_ERROR"},
+		{`{{timestamp "format=bogus"}}`, "TEMPLATE_ERROR"},
+		{`{{dict "notloaded"}}`, "TEMPLATE_ERROR"},
+		{`{{if}}`, "TEMPLATE_ERROR"},
+	}
+	for _, c := range cases {
+		output := renderTemplate(c.text, "Jan 02 15:04:05", scope, now)
+		if output != c.desiredOutput {
+			t.Errorf("Failed case: {%q,%q} >> %q", c.text, c.desiredOutput, output)
+		}
+	}
+
+	if err := ValidateTemplate(`{{bogusFunction}}`); err == nil {
+		t.Errorf("Failed negative validation case")
+	}
+}
+
+func TestRenderJSONEvent(t *testing.T) {
+	var line struct {
+		Fields FieldList `json:"Fields"`
+	}
+	schema := `{"Fields": {
+		"zeta": {"Type": "string", "Value": "say \"$[hi||hi]\""},
+		"alpha": {"Type": "int", "Value": "$[200||201]"},
+		"latency": {"Type": "float", "Min": 1.5, "Max": 1.5, "Precision": 2},
+		"ok": {"Type": "bool", "Value": "true"},
+		"never": {"Type": "string", "Value": "x", "Probability": 0},
+		"always": {"Type": "null", "Probability": 1},
+		"ts": {"Type": "timestamp", "Format": "epoch", "Offset": "0s"},
+		"request": {"Type": "object", "Fields": {"path": {"Type": "string", "Value": "/"}}},
+		"tags": {"Type": "array", "MinItems": 2, "MaxItems": 2, "Items": {"Type": "int", "Min": 3, "Max": 3}}
+	}}`
+	if err := json.Unmarshal([]byte(schema), &line); err != nil {
+		t.Fatalf("Couldn't unmarshal schema: %q", err)
+	}
+	if err := ValidateFields(line.Fields); err != nil {
+		t.Fatalf("Failed validating schema: %q", err)
+	}
+
+	now, _ := time.Parse(time.RFC3339, "2016-01-02T15:04:05Z")
+	output := renderJSONEvent(line.Fields, "", TokenScope{}, now)
+	desiredOutput := `{"zeta":"say \"hi\"","alpha":200,"latency":1.50,"ok":true,"always":null,"ts":1451747045,"request":{"path":"/"},"tags":[3,3]}`
+	if output != desiredOutput {
+		t.Errorf("Failed case: %q >> %q", desiredOutput, output)
+	}
+
+	negativeCases := []string{
+		`{"Fields": {}}`,
+		`{"Fields": {"a": {"Type": "bogus"}}}`,
+		`{"Fields": {"a": {"Type": "int", "Min": 5, "Max": 1}}}`,
+		`{"Fields": {"a": {"Type": "string", "Probability": 2}}}`,
+		`{"Fields": {"a": {"Type": "timestamp", "Format": "bogus"}}}`,
+		`{"Fields": {"a": {"Type": "array", "MaxItems": 2}}}`,
+		`{"Fields": {"a": {"Type": "object", "Fields": {"b": {"Type": "bogus"}}}}}`,
+		`{"Fields": {"a": {"Type": "string", "Value": "$[regex||(unclosed]"}}}`,
+		`{"Fields": {"a": {"Type": "array", "Items": {"Type": "int", "Value": "$[time||stamp||format=bogus]"}}}}`,
+	}
+	for _, c := range negativeCases {
+		line.Fields = nil
+		if err := json.Unmarshal([]byte(c), &line); err != nil {
+			continue
+		}
+		if err := ValidateFields(line.Fields); err == nil {
+			t.Errorf("Failed negative case: %q", c)
+		}
+	}
+
+	// Values that don't parse as their type fail the whole event
+	badInt := FieldList{{Name: "a", Type: "int", Value: "$[x||y]"}}
+	if output := RenderJSONEvent(badInt, "", TokenScope{}); output != "JSON_ERROR" {
+		t.Errorf("Failed bad int case >> %q", output)
+	}
+}
+
+func TestRegexTokens(t *testing.T) {
+	patterns := []string{
+		`ORD-[A-Z]{3}-\d{6}`,
+		`S-1-5-21-\d{9,10}-\d{9,10}-\d{9,10}-\d{3,5}`,
+		`(GET|POST) /api/v[12]/\w+`,
+		`[^,]+,a*b+c?`,
+		`(?i)abc.`,
+		`^x{2,}$`,
+	}
+	for _, p := range patterns {
+		check := regexp.MustCompile("^(?:" + p + ")$")
+		for i := 0; i < 20; i++ {
+			output := RandomizeString("<$[regex||"+p+"]>", "", TokenScope{})
+			if len(output) < 2 || !check.MatchString(output[1:len(output)-1]) {
+				t.Errorf("Failed case: %q >> %q", p, output)
+				break
+			}
+		}
+	}
+
+	// Case folding stays in ASCII
+	for i := 0; i < 50; i++ {
+		if output := RandomizeString("$[regex||(?i)ks]", "", TokenScope{}); len(output) != 2 {
+			t.Errorf("Failed ASCII fold case >> %q", output)
+			break
+		}
+	}
+
+	// Brackets outside of tokens are left alone
+	if output := RandomizeString("$[7||8] [INFO] $[regex||[a]] ]", "", TokenScope{}); output != "7 [INFO] a ]" {
+		t.Errorf("Failed bracket case >> %q", output)
+	}
+
+	// POSIX classes and escaped brackets stay inside the token
+	bracketCases := []struct {
+		text   string
+		output string
+	}{
+		{"<$[regex||[[:digit:]]{3}]>", `^<[0-9]{3}>$`},
+		{"<$[regex||[[:alpha:][:digit:]]]>", `^<[a-zA-Z0-9]>$`},
+		{`<$[regex||a\]]>`, `^<a\]>$`},
+		{`<$[regex||[\]x]{2}]>`, `^<[\]x]{2}>$`},
+		{`<$[regex||\[[ab]\]]>`, `^<\[[ab]\]>$`},
+	}
+	for _, c := range bracketCases {
+		if output := RandomizeString(c.text, "", TokenScope{}); !regexp.MustCompile(c.output).MatchString(output) {
+			t.Errorf("Failed case: {%q,%q} >> %q", c.text, c.output, output)
+		}
+	}
+
+	if err := ValidateTokens("fine $[0||5] $[regex||[0-9]+] $[time||stamp||format=%Y-%m-%d||offset=-1h..0s]"); err != nil {
+		t.Errorf("Failed positive validation case >> %q", err)
+	}
+	for _, c := range []string{"$[regex||(unclosed]", "$[regex||a{2,1}]", "$[time||stamp||format=bogus]", "$[time||stamp||format=%Q]", "$[time||stamp||offset=5x]", "$[time||stamp||offset=1s..-1s]", "$[time||stamp||zone=UTC]", "$[time||stamp||format]"} {
+		if err := ValidateTokens(c); err == nil {
+			t.Errorf("Failed negative validation case: %q", c)
+		}
+	}
+}
+
+func TestVariableTokens(t *testing.T) {
+	scope := TokenScope{LineID: "flow.data:login", SourceFile: "flow.data", Vars: map[string]string{"session": "abc123", "user": "Sophie"}}
+
+	if output := RandomizeString("user=$[var||user] session=$[var||session]", "", scope); output != "user=Sophie session=abc123" {
+		t.Errorf("Failed token case >> %q", output)
+	}
+	if output := RenderTemplate(`{{var "user"}} {{.Vars.session}}`, "", scope); output != "Sophie abc123" {
+		t.Errorf("Failed template case >> %q", output)
+	}
+	if output, err := getOneToken("$[var||missing]", "", scope, time.Now()); err == nil {
+		t.Errorf("Failed missing variable case >> %q", output)
+	}
+}
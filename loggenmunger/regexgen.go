@@ -0,0 +1,169 @@
+package loggenmunger
+
+import (
+	"errors"
+	"math/rand"
+	"regexp/syntax"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxRegexRepeat bounds the unbounded repetitions * and +, as well as {n,}
+const maxRegexRepeat = 10
+
+// regexGenerators caches parsed patterns, since every line is rendered over and over
+var regexGenerators = struct {
+	sync.RWMutex
+	m map[string]*syntax.Regexp
+}{m: make(map[string]*syntax.Regexp)}
+
+// printableASCII is the range random characters are drawn from when a
+// pattern allows (almost) anything, like . or [^,]
+var printableASCII = []rune{0x20, 0x7e}
+
+// getRegexValue handles $[regex||pattern] tokens, returning a random string
+// that matches the Go syntax regular expression
+func getRegexValue(pattern string) (string, error) {
+	re, err := getRegexGenerator(pattern)
+	if err != nil {
+		return "", err
+	}
+
+	var out []rune
+	out = generateRegex(re, out)
+	return string(out), nil
+}
+
+// getRegexGenerator parses a pattern or fetches it from the cache
+func getRegexGenerator(pattern string) (*syntax.Regexp, error) {
+	regexGenerators.RLock()
+	re, ok := regexGenerators.m[pattern]
+	regexGenerators.RUnlock()
+	if ok {
+		return re, nil
+	}
+
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, errors.New("Regex token pattern is not valid: " + err.Error())
+	}
+	re = re.Simplify()
+
+	regexGenerators.Lock()
+	regexGenerators.m[pattern] = re
+	regexGenerators.Unlock()
+
+	return re, nil
+}
+
+// generateRegex walks the parsed pattern, appending random matching runes
+func generateRegex(re *syntax.Regexp, out []rune) []rune {
+	switch re.Op {
+	case syntax.OpLiteral:
+		for _, r := range re.Rune {
+			if re.Flags&syntax.FoldCase != 0 && rand.Intn(2) == 1 {
+				r = foldRune(r)
+			}
+			out = append(out, r)
+		}
+	case syntax.OpCharClass:
+		out = append(out, randomRune(re.Rune))
+	case syntax.OpAnyCharNotNL, syntax.OpAnyChar:
+		out = append(out, randomRune(printableASCII))
+	case syntax.OpCapture:
+		out = generateRegex(re.Sub[0], out)
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			out = generateRegex(sub, out)
+		}
+	case syntax.OpAlternate:
+		out = generateRegex(re.Sub[rand.Intn(len(re.Sub))], out)
+	case syntax.OpStar:
+		out = repeatRegex(re.Sub[0], 0, maxRegexRepeat, out)
+	case syntax.OpPlus:
+		out = repeatRegex(re.Sub[0], 1, maxRegexRepeat, out)
+	case syntax.OpQuest:
+		out = repeatRegex(re.Sub[0], 0, 1, out)
+	case syntax.OpRepeat:
+		max := re.Max
+		if max == -1 {
+			max = re.Min + maxRegexRepeat
+		}
+		out = repeatRegex(re.Sub[0], re.Min, max, out)
+	}
+
+	// Anchors, word boundaries and empty matches don't produce any text
+	return out
+}
+
+// foldRune swaps the case of a rune. ASCII letters only swap with ASCII, so
+// (?i)k never gives the Kelvin sign, or s the long s.
+func foldRune(r rune) rune {
+	if r < utf8.RuneSelf {
+		if unicode.IsUpper(r) {
+			return unicode.ToLower(r)
+		}
+		return unicode.ToUpper(r)
+	}
+	return unicode.SimpleFold(r)
+}
+
+// repeatRegex generates between min and max copies of a sub pattern
+func repeatRegex(re *syntax.Regexp, min int, max int, out []rune) []rune {
+	count := min
+	if max > min {
+		count += rand.Intn(max - min + 1)
+	}
+	for i := 0; i < count; i++ {
+		out = generateRegex(re, out)
+	}
+	return out
+}
+
+// randomRune picks a rune out of a character class, given as pairs of
+// inclusive ranges. Classes are narrowed to printable ASCII if that leaves
+// anything to pick, so negated classes don't produce control characters.
+func randomRune(ranges []rune) rune {
+	if len(ranges) == 0 {
+		return 0
+	}
+
+	if narrowed := intersectRanges(ranges, printableASCII); len(narrowed) > 0 {
+		ranges = narrowed
+	}
+
+	var total int64
+	for i := 0; i < len(ranges); i += 2 {
+		total += int64(ranges[i+1]-ranges[i]) + 1
+	}
+
+	pick := rand.Int63n(total)
+	for i := 0; i < len(ranges); i += 2 {
+		size := int64(ranges[i+1]-ranges[i]) + 1
+		if pick < size {
+			return ranges[i] + rune(pick)
+		}
+		pick -= size
+	}
+
+	return ranges[0]
+}
+
+// intersectRanges narrows a list of rune ranges to a single range
+func intersectRanges(ranges []rune, bounds []rune) []rune {
+	var out []rune
+	for i := 0; i < len(ranges); i += 2 {
+		low, high := ranges[i], ranges[i+1]
+		if low < bounds[0] {
+			low = bounds[0]
+		}
+		if high > bounds[1] {
+			high = bounds[1]
+		}
+		if low <= high {
+			out = append(out, low, high)
+		}
+	}
+	return out
+}
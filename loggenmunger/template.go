@@ -0,0 +1,167 @@
+package loggenmunger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// templates caches parsed templates by their text, since every line is
+// rendered over and over
+var templates = struct {
+	sync.RWMutex
+	m map[string]*template.Template
+}{m: make(map[string]*template.Template)}
+
+// TemplateData is the dot value available inside a template
+type TemplateData struct {
+	Now             time.Time
+	TimestampFormat string
+	LineID          string
+	SourceFile      string
+	Vars            map[string]string
+}
+
+// templateFuncs builds the function map for one render of a template. The
+// functions are bound to the render's instant and scope so that timestamps
+// and counters behave the same as their $[...] token equivalents.
+func templateFuncs(timeformat string, scope TokenScope, now time.Time) template.FuncMap {
+	return template.FuncMap{
+		"randInt": func(min, max int) (int, error) {
+			if max <= min {
+				return 0, errors.New("randInt needs a max larger than its min")
+			}
+			return rand.Intn(max-min) + min, nil
+		},
+		"randFloat": func(min, max float64) float64 {
+			return rand.Float64()*(max-min) + min
+		},
+		"choice": func(items ...string) (string, error) {
+			if len(items) == 0 {
+				return "", errors.New("choice needs at least one item")
+			}
+			return items[rand.Intn(len(items))], nil
+		},
+		"chance": func(probability float64) bool {
+			return rand.Float64() < probability
+		},
+		"timestamp": func(options ...string) (string, error) {
+			t, format, err := getTimestampOptions(options, timeformat, now)
+			if err != nil {
+				return "", err
+			}
+			formatted, err := formatTimestamp(t, format)
+			if err == nil && formatted == "TIME_FORMAT_ERROR" {
+				err = errors.New("Timestamp format is not valid: " + format)
+			}
+			return formatted, err
+		},
+		"dict": getDictionaryValue,
+		"var": func(name string) (string, error) {
+			return getVariableValue(name, scope)
+		},
+		"counter": func(options ...string) (string, error) {
+			return getCounterValue("template:counter:"+strings.Join(options, "||"), append([]string{"counter"}, options...), scope)
+		},
+		"sequence": func(items ...string) (string, error) {
+			return getSequenceValue("template:sequence:"+strings.Join(items, "||"), append([]string{"sequence"}, items...), scope)
+		},
+		"regex": getRegexValue,
+		"uuid":  randomUUID,
+		"ipv4": func(cidr ...string) (string, error) {
+			if len(cidr) > 1 {
+				return "", errors.New("ipv4 takes at most one CIDR block")
+			}
+			return randomIPv4(strings.Join(cidr, ""))
+		},
+		"mac": randomMAC,
+		"hex": func(n int) (string, error) {
+			if n < 0 {
+				return "", errors.New("hex needs a non-negative length")
+			}
+			return randomHex(n), nil
+		},
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}
+}
+
+// getTemplate parses a template or fetches it from the cache
+func getTemplate(text string) (*template.Template, error) {
+	templates.RLock()
+	tmpl, ok := templates.m[text]
+	templates.RUnlock()
+	if ok {
+		return tmpl, nil
+	}
+
+	// The real functions are bound at render time, these are just for parsing
+	tmpl, err := template.New("line").Funcs(templateFuncs("", TokenScope{}, time.Time{})).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	templates.Lock()
+	templates.m[text] = tmpl
+	templates.Unlock()
+
+	return tmpl, nil
+}
+
+// ValidateTemplate checks that a line's text parses as a Go text/template
+func ValidateTemplate(text string) error {
+	_, err := getTemplate(text)
+	return err
+}
+
+// RenderTemplate renders a line's text as a Go text/template, with all the
+// loggenmunger generators available as functions
+func RenderTemplate(text string, timeformat string, scope TokenScope) string {
+	return renderTemplate(text, timeformat, scope, time.Now())
+}
+
+// renderTemplate renders a template as of the instant now
+func renderTemplate(text string, timeformat string, scope TokenScope, now time.Time) string {
+	log.WithFields(log.Fields{
+		"text":       text,
+		"timeformat": timeformat,
+	}).Debug("Starting template rendering")
+
+	tmpl, err := getTemplate(text)
+	if err == nil {
+		// Clone so the functions can be bound to this render without racing other workers
+		tmpl, err = tmpl.Clone()
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error_msg": err,
+			"text":      text,
+		}).Warn("Couldn't parse the template. Using default TEMPLATE_ERROR")
+		return "TEMPLATE_ERROR"
+	}
+
+	data := TemplateData{Now: now, TimestampFormat: timeformat, LineID: scope.LineID, SourceFile: scope.SourceFile, Vars: scope.Vars}
+
+	var out bytes.Buffer
+	err = tmpl.Funcs(templateFuncs(timeformat, scope, now)).Execute(&out, data)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error_msg": err,
+			"text":      text,
+		}).Warn("Couldn't render the template. Using default TEMPLATE_ERROR")
+		return "TEMPLATE_ERROR"
+	}
+
+	log.Debug("Template rendering complete: ", "newString - ", out.String())
+
+	return out.String()
+}
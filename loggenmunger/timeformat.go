@@ -0,0 +1,306 @@
+package loggenmunger
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timestampPresets are named formats for common log timestamps
+var timestampPresets = map[string]string{
+	"RFC3339":     time.RFC3339,
+	"RFC3339Nano": time.RFC3339Nano,
+	"ISO8601":     "2006-01-02T15:04:05.000Z07:00",
+	"RFC1123":     time.RFC1123,
+	"RFC1123Z":    time.RFC1123Z,
+	"syslog":      "Jan _2 15:04:05",
+	"RFC3164":     "Jan _2 15:04:05",
+	"RFC5424":     "2006-01-02T15:04:05.000000Z07:00",
+	"apache":      "02/Jan/2006:15:04:05 -0700",
+	"CLF":         "02/Jan/2006:15:04:05 -0700",
+	"W3C":         "2006-01-02 15:04:05",
+}
+
+// strftimeDirectives maps strftime conversions to the equivalent Go layout
+var strftimeDirectives = map[byte]string{
+	'Y': "2006",
+	'y': "06",
+	'm': "01",
+	'd': "02",
+	'e': "_2",
+	'H': "15",
+	'I': "03",
+	'M': "04",
+	'S': "05",
+	'p': "PM",
+	'b': "Jan",
+	'h': "Jan",
+	'B': "January",
+	'a': "Mon",
+	'A': "Monday",
+	'Z': "MST",
+	'z': "-0700",
+	'j': "002",
+	'F': "2006-01-02",
+	'T': "15:04:05",
+	'D': "01/02/06",
+	'R': "15:04",
+}
+
+// ValidateTimeFormat checks that a timestamp format can be used to render a
+// timestamp, returning an error describing the problem if not
+func ValidateTimeFormat(timeformat string) error {
+	referenceTime, _ := time.Parse(time.RFC3339, "2016-01-01T00:00:00+00:00")
+	_, err := FormatTime(referenceTime, timeformat)
+	return err
+}
+
+// FormatTime renders a time with any of the timestamp formats lines can use,
+// for outputs that need a timestamp outside of the line's text
+func FormatTime(t time.Time, timeformat string) (string, error) {
+	formatted, err := formatTimestamp(t, timeformat)
+	if err == nil && formatted == "TIME_FORMAT_ERROR" {
+		err = errors.New("Timestamp format does not contain any date or time elements: " + timeformat)
+	}
+	return formatted, err
+}
+
+// DatePattern finds the %{+format} date parts of a name, like the index in
+// logs-%{+yyyy.MM.dd}
+var DatePattern = regexp.MustCompile(`%\{\+([^}]+)\}`)
+
+// ValidateDatePattern checks the formats of every date part of a name
+func ValidateDatePattern(pattern string) error {
+	for _, match := range DatePattern.FindAllStringSubmatch(pattern, -1) {
+		if err := ValidateTimeFormat(match[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FormatDatePattern fills in the date parts of a name with a time
+func FormatDatePattern(pattern string, t time.Time) string {
+	return DatePattern.ReplaceAllStringFunc(pattern, func(match string) string {
+		formatted, _ := FormatTime(t, DatePattern.FindStringSubmatch(match)[1])
+		return formatted
+	})
+}
+
+// javaPatternRun is a doubled Java pattern letter, which is how almost every
+// Java pattern writes its fields, like yyyy, MM, dd, HH, mm or ss
+var javaPatternRun = regexp.MustCompile(`yy|YY|MM|dd|DD|EE|HH|hh|kk|KK|mm|ss|SS`)
+
+// isJavaFormat guesses whether a format is a Java SimpleDateFormat or Joda
+// pattern. Anything with a java: prefix is, as is anything with a doubled
+// pattern letter that has none of Go's reference layout parts in it.
+func isJavaFormat(timeformat string) bool {
+	if strings.HasPrefix(timeformat, "java:") {
+		return true
+	}
+	if !javaPatternRun.MatchString(timeformat) {
+		return false
+	}
+	referenceTime := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	return referenceTime.Format(timeformat) == timeformat
+}
+
+// formatStrftime renders a time according to a strftime format like
+// %Y-%m-%d %H:%M:%S. %f is microseconds, %L milliseconds and %N nanoseconds.
+func formatStrftime(t time.Time, timeformat string) (string, error) {
+	var out []string
+	var literal []byte
+
+	for i := 0; i < len(timeformat); i++ {
+		if timeformat[i] != '%' {
+			literal = append(literal, timeformat[i])
+			continue
+		}
+		if i == len(timeformat)-1 {
+			return "", errors.New("Timestamp format ends with a lone %: " + timeformat)
+		}
+		i++
+
+		var piece string
+		switch directive := timeformat[i]; directive {
+		case '%':
+			literal = append(literal, '%')
+			continue
+		case 'n':
+			literal = append(literal, '\n')
+			continue
+		case 't':
+			literal = append(literal, '\t')
+			continue
+		case 's':
+			piece = strconv.FormatInt(t.Unix(), 10)
+		case 'f':
+			piece = fmt.Sprintf("%06d", t.Nanosecond()/1000)
+		case 'L':
+			piece = fmt.Sprintf("%03d", t.Nanosecond()/1000000)
+		case 'N':
+			piece = fmt.Sprintf("%09d", t.Nanosecond())
+		default:
+			layout, ok := strftimeDirectives[directive]
+			if !ok {
+				return "", errors.New("Unknown strftime directive %" + string(directive) + " in timestamp format: " + timeformat)
+			}
+			piece = t.Format(layout)
+		}
+
+		out = append(out, string(literal), piece)
+		literal = literal[:0]
+	}
+
+	if len(out) == 0 {
+		return "", errors.New("Timestamp format has no strftime directives: " + timeformat)
+	}
+	out = append(out, string(literal))
+
+	return strings.Join(out, ""), nil
+}
+
+// formatJava renders a time according to a Java SimpleDateFormat or Joda
+// pattern like yyyy-MM-dd HH:mm:ss.SSS. Text in single quotes is literal.
+func formatJava(t time.Time, timeformat string) (string, error) {
+	pattern := strings.TrimPrefix(timeformat, "java:")
+
+	var out []string
+	letters := 0
+	for i := 0; i < len(pattern); {
+		c := pattern[i]
+
+		// Quoted literal text, with '' standing in for a single quote
+		if c == '\'' {
+			if i+1 < len(pattern) && pattern[i+1] == '\'' {
+				out = append(out, "'")
+				i += 2
+				continue
+			}
+			end := strings.IndexByte(pattern[i+1:], '\'')
+			if end == -1 {
+				return "", errors.New("Unterminated quote in timestamp format: " + timeformat)
+			}
+			out = append(out, pattern[i+1:i+1+end])
+			i += end + 2
+			continue
+		}
+
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			out = append(out, string(c))
+			i++
+			continue
+		}
+
+		// Collect the run of the same pattern letter
+		n := 1
+		for i+n < len(pattern) && pattern[i+n] == c {
+			n++
+		}
+		piece, err := javaField(t, c, n)
+		if err != nil {
+			return "", errors.New(err.Error() + " in timestamp format: " + timeformat)
+		}
+		out = append(out, piece)
+		letters++
+		i += n
+	}
+
+	if letters == 0 {
+		return "", errors.New("Timestamp format has no date or time fields: " + timeformat)
+	}
+
+	return strings.Join(out, ""), nil
+}
+
+// javaField renders a run of n copies of one Java pattern letter
+func javaField(t time.Time, c byte, n int) (string, error) {
+	pad := func(v int) string { return fmt.Sprintf("%0*d", n, v) }
+
+	switch c {
+	case 'G':
+		return "AD", nil
+	case 'y':
+		if n == 2 {
+			return t.Format("06"), nil
+		}
+		return pad(t.Year()), nil
+	case 'Y':
+		// Week year, the way SimpleDateFormat does it in the US: weeks
+		// start on Sunday, and the week with January 1st in it is the
+		// first week of the year, so the last days of December can be in
+		// next year's first week
+		year := t.Year()
+		saturday := t.AddDate(0, 0, 6-int(t.Weekday()))
+		if saturday.Year() > year {
+			year = saturday.Year()
+		}
+		if n == 2 {
+			return fmt.Sprintf("%02d", year%100), nil
+		}
+		return pad(year), nil
+	case 'M', 'L':
+		switch {
+		case n >= 4:
+			return t.Format("January"), nil
+		case n == 3:
+			return t.Format("Jan"), nil
+		}
+		return pad(int(t.Month())), nil
+	case 'd':
+		return pad(t.Day()), nil
+	case 'D':
+		return pad(t.YearDay()), nil
+	case 'E':
+		if n >= 4 {
+			return t.Format("Monday"), nil
+		}
+		return t.Format("Mon"), nil
+	case 'a':
+		return t.Format("PM"), nil
+	case 'H':
+		return pad(t.Hour()), nil
+	case 'k':
+		if t.Hour() == 0 {
+			return pad(24), nil
+		}
+		return pad(t.Hour()), nil
+	case 'K':
+		return pad(t.Hour() % 12), nil
+	case 'h':
+		if t.Hour()%12 == 0 {
+			return pad(12), nil
+		}
+		return pad(t.Hour() % 12), nil
+	case 'm':
+		return pad(t.Minute()), nil
+	case 's':
+		return pad(t.Second()), nil
+	case 'S':
+		fraction := fmt.Sprintf("%09d", t.Nanosecond())
+		if n <= 9 {
+			return fraction[:n], nil
+		}
+		return fraction + strings.Repeat("0", n-9), nil
+	case 'z':
+		return t.Format("MST"), nil
+	case 'Z':
+		if n == 2 {
+			return t.Format("-07:00"), nil
+		}
+		return t.Format("-0700"), nil
+	case 'X':
+		switch n {
+		case 1:
+			return t.Format("Z07"), nil
+		case 2:
+			return t.Format("Z0700"), nil
+		}
+		return t.Format("Z07:00"), nil
+	}
+
+	return "", errors.New("Unknown pattern letter " + string(c))
+}
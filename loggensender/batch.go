@@ -0,0 +1,90 @@
+package loggensender
+
+import (
+	"time"
+)
+
+// Defaults for outputs that send lines in batches
+const (
+	defaultBatchSize   = 100
+	defaultBatchMillis = 1000
+)
+
+// batcher collects lines for outputs that send several at once, and hands
+// them over when the batch is full or has waited long enough
+type batcher struct {
+	size     int
+	interval time.Duration
+	lines    chan queuedLine
+	stop     chan chan bool
+	flush    func(lines []queuedLine)
+}
+
+// batchers are all the running batchers, so what they're holding can be sent
+// when gologgen stops
+var batchers []*batcher
+
+// newBatcher starts collecting lines into batches. Zero size and millis
+// fall back to the defaults.
+func newBatcher(size int, millis int, flush func(lines []queuedLine)) *batcher {
+	if size == 0 {
+		size = defaultBatchSize
+	}
+	if millis == 0 {
+		millis = defaultBatchMillis
+	}
+
+	b := &batcher{size: size, interval: time.Duration(millis) * time.Millisecond, lines: make(chan queuedLine, size), stop: make(chan chan bool), flush: flush}
+	batchers = append(batchers, b)
+	go b.run()
+	return b
+}
+
+// StopBatchers sends each batcher's current batch, and stops them
+func StopBatchers() {
+	for _, b := range batchers {
+		done := make(chan bool)
+		b.stop <- done
+		<-done
+	}
+	batchers = nil
+}
+
+// add puts a line in the current batch, waiting if the batcher is busy
+// flushing, so a slow output holds up its queue
+func (b *batcher) add(stringBody []byte, params LogLineProperties) {
+	b.lines <- queuedLine{body: stringBody, params: params}
+}
+
+func (b *batcher) run() {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	var batch []queuedLine
+	for {
+		select {
+		case line := <-b.lines:
+			batch = append(batch, line)
+			if len(batch) < b.size {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case done := <-b.stop:
+			// Take whatever was added before stopping too
+			for len(b.lines) > 0 {
+				batch = append(batch, <-b.lines)
+			}
+			if len(batch) > 0 {
+				b.flush(batch)
+			}
+			done <- true
+			return
+		}
+
+		b.flush(batch)
+		batch = nil
+	}
+}
@@ -0,0 +1,300 @@
+package loggensender
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ftwynn/gologgen/loggenmunger"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// ElasticsearchConf holds the settings for the Elasticsearch/OpenSearch bulk output
+type ElasticsearchConf struct {
+	URLs           []string `json:"URLs"`
+	Index          string   `json:"Index"`
+	Action         string   `json:"Action"`
+	Pipeline       string   `json:"Pipeline"`
+	Username       string   `json:"Username"`
+	Password       string   `json:"Password"`
+	APIKey         string   `json:"APIKey"`
+	TimestampField string   `json:"TimestampField"`
+	MessageField   string   `json:"MessageField"`
+	BatchSize      int      `json:"BatchSize"`
+	BatchMillis    int      `json:"BatchMillis"`
+	MaxRetries     int      `json:"MaxRetries"`
+	TLS            TLSConf  `json:"TLS"`
+}
+
+// esBulkItem is one document in a bulk request, kept so failed items can be
+// sent again on their own
+type esBulkItem struct {
+	action   []byte
+	document []byte
+	params   LogLineProperties
+}
+
+// esBulkResponse is the part of the bulk API's reply needed to find failed items
+type esBulkResponse struct {
+	Errors bool                            `json:"errors"`
+	Items  []map[string]esBulkResponseItem `json:"items"`
+}
+
+type esBulkResponseItem struct {
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+// Defaults for the Elasticsearch output
+const (
+	defaultESAction         = "index"
+	defaultESTimestampField = "@timestamp"
+	defaultESMessageField   = "message"
+	defaultESMaxRetries     = 3
+)
+
+// elasticsearch holds the running Elasticsearch output
+var elasticsearch struct {
+	conf    ElasticsearchConf
+	client  *http.Client
+	batcher *batcher
+	next    uint64
+}
+
+// ValidateElasticsearchConf checks the Elasticsearch settings before anything is sent
+func ValidateElasticsearchConf(conf ElasticsearchConf) error {
+	if len(conf.URLs) == 0 {
+		return errors.New("Elasticsearch needs at least one URL in URLs")
+	}
+	for _, u := range conf.URLs {
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			return errors.New("Elasticsearch URLs must start with http:// or https://: " + u)
+		}
+	}
+	if conf.Index == "" {
+		return errors.New("Elasticsearch needs a default Index")
+	}
+	if err := loggenmunger.ValidateDatePattern(conf.Index); err != nil {
+		return err
+	}
+	if conf.Action != "" && conf.Action != "index" && conf.Action != "create" {
+		return errors.New("Elasticsearch Action must be in (index, create): " + conf.Action)
+	}
+	if conf.APIKey != "" && conf.Username != "" {
+		return errors.New("Elasticsearch can use a Username and Password, or an APIKey, but not both")
+	}
+	if conf.BatchSize < 0 || conf.BatchMillis < 0 || conf.MaxRetries < 0 {
+		return errors.New("Elasticsearch BatchSize, BatchMillis and MaxRetries cannot be negative")
+	}
+	return nil
+}
+
+// StartElasticsearch sets up the Elasticsearch client and batching
+func StartElasticsearch(conf ElasticsearchConf) error {
+	client := &http.Client{Timeout: 60 * time.Second}
+	if conf.TLS.Enabled {
+		tlsConfig, err := conf.TLS.Config()
+		if err != nil {
+			return err
+		}
+		client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+
+	if conf.Action == "" {
+		conf.Action = defaultESAction
+	}
+	if conf.TimestampField == "" {
+		conf.TimestampField = defaultESTimestampField
+	}
+	if conf.MessageField == "" {
+		conf.MessageField = defaultESMessageField
+	}
+	if conf.MaxRetries == 0 {
+		conf.MaxRetries = defaultESMaxRetries
+	}
+
+	elasticsearch.conf = conf
+	elasticsearch.client = client
+	elasticsearch.batcher = newBatcher(conf.BatchSize, conf.BatchMillis, flushElasticsearch)
+
+	return nil
+}
+
+// sendLogLineElasticsearch adds the log line to the next bulk request
+func sendLogLineElasticsearch(stringBody []byte, params LogLineProperties) {
+	if elasticsearch.batcher == nil {
+		log.Error("Elasticsearch output used without Elasticsearch settings in the global conf, dropping line")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"line": string(stringBody),
+	}).Info("Sending log to Elasticsearch")
+
+	elasticsearch.batcher.add(stringBody, params)
+}
+
+// esIndexName works out the index for a line, filling in the date parts
+// from the time the line was generated
+func esIndexName(params LogLineProperties) string {
+	pattern := params.ESIndex
+	if pattern == "" {
+		pattern = elasticsearch.conf.Index
+	}
+
+	scope := loggenmunger.TokenScope{LineID: params.LineID, SourceFile: params.SourceFile, Vars: params.Vars}
+	index := loggenmunger.RandomizeString(pattern, params.TimestampFormat, scope)
+
+	return loggenmunger.FormatDatePattern(index, params.GeneratedAt.UTC())
+}
+
+// esDocument turns a line into a document. JSON object lines are sent as
+// they are, and anything else goes in the message field with a timestamp.
+func esDocument(stringBody []byte, params LogLineProperties) []byte {
+	if bytes.HasPrefix(stringBody, []byte("{")) && json.Valid(stringBody) {
+		return stringBody
+	}
+
+	document, _ := json.Marshal(map[string]string{
+		elasticsearch.conf.TimestampField: params.GeneratedAt.UTC().Format(time.RFC3339Nano),
+		elasticsearch.conf.MessageField:   string(stringBody),
+	})
+	return document
+}
+
+// flushElasticsearch sends a batch of lines with the bulk API, then sends
+// any items that failed for a temporary reason again on their own
+func flushElasticsearch(lines []queuedLine) {
+	items := make([]esBulkItem, 0, len(lines))
+	for _, line := range lines {
+		action, _ := json.Marshal(map[string]map[string]string{
+			elasticsearch.conf.Action: {"_index": esIndexName(line.params)},
+		})
+		items = append(items, esBulkItem{action: action, document: esDocument(line.body, line.params), params: line.params})
+	}
+
+	for attempt := 0; len(items) > 0; attempt++ {
+		if attempt > 0 {
+			if attempt > elasticsearch.conf.MaxRetries {
+				log.WithFields(log.Fields{
+					"items": len(items),
+				}).Error("Elasticsearch items still failing after retries, dropping them")
+				return
+			}
+			time.Sleep(time.Duration(1<<uint(attempt-1)) * time.Second)
+		}
+
+		var err error
+		items, err = postBulk(items)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error_msg":     err,
+				"attemptNumber": attempt + 1,
+			}).Warn("Elasticsearch bulk request failed")
+		}
+	}
+}
+
+// postBulk sends one bulk request, and returns the items that should be
+// tried again. Items rejected for good are logged and left out.
+func postBulk(items []esBulkItem) ([]esBulkItem, error) {
+	var body bytes.Buffer
+	for _, item := range items {
+		body.Write(item.action)
+		body.WriteByte('\n')
+		body.Write(item.document)
+		body.WriteByte('\n')
+	}
+
+	// Spread requests across the nodes
+	base := elasticsearch.conf.URLs[atomic.AddUint64(&elasticsearch.next, 1)%uint64(len(elasticsearch.conf.URLs))]
+	endpoint := strings.TrimSuffix(base, "/") + "/_bulk"
+	if elasticsearch.conf.Pipeline != "" {
+		endpoint += "?pipeline=" + url.QueryEscape(elasticsearch.conf.Pipeline)
+	}
+
+	req, err := http.NewRequest("POST", endpoint, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if elasticsearch.conf.APIKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+elasticsearch.conf.APIKey)
+	} else if elasticsearch.conf.Username != "" {
+		req.SetBasicAuth(elasticsearch.conf.Username, elasticsearch.conf.Password)
+	}
+
+	resp, err := elasticsearch.client.Do(req)
+	if err != nil {
+		return items, err
+	}
+	defer resp.Body.Close()
+
+	replyBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return items, err
+	}
+
+	// The whole request failed, so everything needs to go again if it's temporary
+	if resp.StatusCode != http.StatusOK {
+		if esRetryable(resp.StatusCode) {
+			return items, errors.New("Elasticsearch responded " + resp.Status)
+		}
+		log.WithFields(log.Fields{
+			"statusCode": resp.StatusCode,
+			"response":   string(replyBody),
+			"items":      len(items),
+		}).Error("Elasticsearch rejected the bulk request, dropping it")
+		return nil, nil
+	}
+
+	var response esBulkResponse
+	if err := json.Unmarshal(replyBody, &response); err != nil {
+		return nil, errors.New("Couldn't parse the Elasticsearch bulk response: " + err.Error())
+	}
+	if !response.Errors {
+		for _, item := range items {
+			countSent(item.params)
+		}
+		return nil, nil
+	}
+
+	var retry []esBulkItem
+	for i, result := range response.Items {
+		if i >= len(items) {
+			break
+		}
+		for _, item := range result {
+			if item.Status < 300 {
+				countSent(items[i].params)
+				continue
+			}
+			if esRetryable(item.Status) {
+				retry = append(retry, items[i])
+				continue
+			}
+			log.WithFields(log.Fields{
+				"status":   item.Status,
+				"error":    string(item.Error),
+				"document": string(items[i].document),
+			}).Error("Elasticsearch rejected a document")
+		}
+	}
+
+	if len(retry) > 0 {
+		return retry, errors.New("Some items were rejected for a temporary reason")
+	}
+	return nil, nil
+}
+
+// esRetryable says whether a status means the request might work later
+func esRetryable(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
@@ -0,0 +1,437 @@
+package loggensender
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ftwynn/gologgen/loggenmunger"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// FileOutputConf holds the rotation, buffering and open file settings for the file output
+type FileOutputConf struct {
+	MaxSizeMB     float64 `json:"MaxSizeMB"`
+	RotateEvery   string  `json:"RotateEvery"`
+	RotatedName   string  `json:"RotatedName"`
+	MaxFiles      int     `json:"MaxFiles"`
+	Compress      bool    `json:"Compress"`
+	Append        bool    `json:"Append"`
+	CopyTruncate  bool    `json:"CopyTruncate"`
+	MaxOpenFiles  int     `json:"MaxOpenFiles"`
+	FlushMillis   int     `json:"FlushMillis"`
+	ReorderMillis int     `json:"ReorderMillis"`
+	Fsync         string  `json:"Fsync"`
+	WriteRetries  int     `json:"WriteRetries"`
+}
+
+const (
+	defaultRotatedName   = "{path}.{n}"
+	defaultMaxOpenFiles  = 64
+	defaultFlushMillis   = 200
+	defaultReorderMillis = 100
+	defaultWriteRetries  = 5
+	minRotateEvery       = time.Second
+)
+
+// RotatingFile is an output file that's rotated when it gets too big or
+// too old, like logrotate would do to an application's log
+type RotatingFile struct {
+	mu   sync.Mutex
+	path string
+	conf FileOutputConf
+	file *os.File
+
+	maxSize    int64
+	every      time.Duration
+	size       int64
+	openedAt   time.Time
+	nextRotate time.Time
+}
+
+// ValidateFileOutputConf checks the file output settings before anything is written
+func ValidateFileOutputConf(conf FileOutputConf) error {
+	if conf.MaxSizeMB < 0 || conf.MaxFiles < 0 || conf.MaxOpenFiles < 0 {
+		return errors.New("FileOutput MaxSizeMB, MaxFiles and MaxOpenFiles cannot be negative")
+	}
+	if conf.FlushMillis < 0 || conf.ReorderMillis < 0 || conf.WriteRetries < 0 {
+		return errors.New("FileOutput FlushMillis, ReorderMillis and WriteRetries cannot be negative")
+	}
+	if conf.Fsync != "" && conf.Fsync != "never" && conf.Fsync != "close" && conf.Fsync != "flush" {
+		return errors.New("FileOutput Fsync must be in (never, close, flush): " + conf.Fsync)
+	}
+	if conf.RotateEvery != "" {
+		every, err := time.ParseDuration(conf.RotateEvery)
+		if err != nil {
+			return errors.New("FileOutput RotateEvery must be a duration like 1h or 30m: " + conf.RotateEvery)
+		}
+		if every < minRotateEvery {
+			return errors.New("FileOutput RotateEvery must be at least 1s")
+		}
+	}
+	if conf.RotatedName != "" {
+		numbered := strings.Contains(conf.RotatedName, "{n}")
+		dated := loggenmunger.DatePattern.MatchString(conf.RotatedName)
+		if numbered == dated {
+			return errors.New("FileOutput RotatedName must have either {n} or date parts like %{+yyyyMMdd}, but not both: " + conf.RotatedName)
+		}
+		dir := filepath.Dir(conf.RotatedName)
+		if strings.Contains(dir, "{n}") || loggenmunger.DatePattern.MatchString(dir) {
+			return errors.New("FileOutput RotatedName can only have {n} or date parts in the file name, not the directory: " + conf.RotatedName)
+		}
+		if err := loggenmunger.ValidateDatePattern(conf.RotatedName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OpenRotatingFile opens the output file, emptying it first unless the
+// settings say to append to it
+func OpenRotatingFile(path string, conf FileOutputConf) (*RotatingFile, error) {
+	if conf.RotatedName == "" {
+		conf.RotatedName = defaultRotatedName
+	}
+	conf.RotatedName = strings.Replace(conf.RotatedName, "{path}", path, -1)
+
+	r := &RotatingFile{path: path, conf: conf, maxSize: int64(conf.MaxSizeMB * 1024 * 1024)}
+	if conf.RotateEvery != "" {
+		r.every, _ = time.ParseDuration(conf.RotateEvery)
+	}
+
+	if err := r.open(!conf.Append); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open opens the file at the output path for appending. Everything is
+// written with O_APPEND so a copytruncate leaves the next write at the start.
+func (r *RotatingFile) open(truncate bool) error {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if truncate {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(r.path, flags, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.file = f
+	r.size = info.Size()
+	r.started(time.Now())
+	return nil
+}
+
+// started resets the clock for a new file. Time based rotation happens on
+// multiples of RotateEvery, so 1h rotates on the hour.
+func (r *RotatingFile) started(now time.Time) {
+	r.openedAt = now
+	if r.every > 0 {
+		r.nextRotate = now.Truncate(r.every).Add(r.every)
+	}
+}
+
+// Write writes to the file, rotating it first if the write would take it
+// past MaxSizeMB or RotateEvery has passed
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	if _, err := r.WriteLines([][]byte{p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// WriteLines writes lines in as few writes as it can, only rotating between
+// lines so a line is never split across files. A failed rotation is logged
+// and the lines go to the current file. Rotating isn't tried again until the
+// next WriteLines for size, or the next RotateEvery for time, so a file that
+// can't be rotated isn't retried for every line. It returns how many lines
+// were written before any error.
+func (r *RotatingFile) WriteLines(lines [][]byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// A file that couldn't be reopened after rotating is tried again
+	if r.file == nil {
+		if err := r.open(false); err != nil {
+			return 0, err
+		}
+	}
+
+	now := time.Now()
+	var pending []byte
+	written, pendingLines := 0, 0
+	rotateFailed := false
+	for _, line := range lines {
+		size := r.size + int64(len(pending))
+		tooBig := !rotateFailed && r.maxSize > 0 && size > 0 && size+int64(len(line)) > r.maxSize
+		if tooBig || (r.every > 0 && !now.Before(r.nextRotate)) {
+			if err := r.write(pending); err != nil {
+				return written, err
+			}
+			written += pendingLines
+			pending, pendingLines = pending[:0], 0
+
+			if err := r.rotate(now); err != nil {
+				log.WithFields(log.Fields{
+					"error_msg": err,
+					"path":      r.path,
+				}).Error("Failed to rotate the output file, still writing to it")
+				if r.file == nil {
+					return written, err
+				}
+				rotateFailed = true
+				if r.every > 0 && !now.Before(r.nextRotate) {
+					r.nextRotate = now.Truncate(r.every).Add(r.every)
+				}
+			}
+		}
+		pending = append(pending, line...)
+		pendingLines++
+	}
+
+	if err := r.write(pending); err != nil {
+		return written, err
+	}
+	return written + pendingLines, nil
+}
+
+// write writes to the current file and keeps count of its size
+func (r *RotatingFile) write(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return err
+}
+
+// Sync flushes the file to disk
+func (r *RotatingFile) Sync() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Sync()
+}
+
+// Close closes the current file, syncing it first unless Fsync is never
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	if r.conf.Fsync != "" && r.conf.Fsync != "never" {
+		r.file.Sync()
+	}
+	return r.file.Close()
+}
+
+// rotate moves the current file aside, or copies it aside and truncates it
+// for copytruncate, then compresses the rotated file and removes old ones
+func (r *RotatingFile) rotate(now time.Time) error {
+	rotated, err := r.rotatedName()
+	if err != nil {
+		return err
+	}
+
+	if r.conf.CopyTruncate {
+		if err := copyFile(r.path, rotated); err != nil {
+			return err
+		}
+		if err := r.file.Truncate(0); err != nil {
+			return err
+		}
+		r.size = 0
+		r.started(now)
+	} else {
+		if r.conf.Fsync != "" && r.conf.Fsync != "never" {
+			r.file.Sync()
+		}
+		r.file.Close()
+		renameErr := os.Rename(r.path, rotated)
+		// Keep writing somewhere even if the rename didn't work. If the file
+		// can't be opened again, the next write tries.
+		if err := r.open(renameErr == nil); err != nil {
+			r.file = nil
+			return err
+		}
+		if renameErr != nil {
+			return renameErr
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"path":    r.path,
+		"rotated": rotated,
+	}).Info("Rotated the output file")
+
+	if r.conf.Compress {
+		if err := gzipFile(rotated); err != nil {
+			return err
+		}
+	}
+	if !strings.Contains(r.conf.RotatedName, "{n}") {
+		return r.pruneDated()
+	}
+	return nil
+}
+
+// rotatedName works out where the current file goes. Numbered names shift
+// the older files up one first, so .1 is always the newest, and drop the
+// ones past MaxFiles. Dated names use the time the file was started, with a
+// counter on the end if that name is taken.
+func (r *RotatingFile) rotatedName() (string, error) {
+	if strings.Contains(r.conf.RotatedName, "{n}") {
+		return r.shiftNumbered()
+	}
+
+	name := loggenmunger.FormatDatePattern(r.conf.RotatedName, r.openedAt)
+	rotated := name
+	for i := 1; fileExists(rotated) || fileExists(rotated+".gz"); i++ {
+		rotated = name + "." + strconv.Itoa(i)
+	}
+	return rotated, nil
+}
+
+// shiftNumbered renames each numbered file to the next number, oldest first
+func (r *RotatingFile) shiftNumbered() (string, error) {
+	numbered := func(n int) string {
+		return strings.Replace(r.conf.RotatedName, "{n}", strconv.Itoa(n), -1)
+	}
+
+	last := 0
+	for fileExists(numbered(last+1)) || fileExists(numbered(last+1)+".gz") {
+		last++
+	}
+	if r.conf.MaxFiles > 0 {
+		for ; last >= r.conf.MaxFiles; last-- {
+			os.Remove(numbered(last))
+			os.Remove(numbered(last) + ".gz")
+		}
+	}
+
+	for n := last; n >= 1; n-- {
+		for _, suffix := range []string{"", ".gz"} {
+			if !fileExists(numbered(n) + suffix) {
+				continue
+			}
+			if err := os.Rename(numbered(n)+suffix, numbered(n+1)+suffix); err != nil {
+				return "", err
+			}
+		}
+	}
+	return numbered(1), nil
+}
+
+// pruneDated removes the oldest dated files past MaxFiles. Only files whose
+// names fit RotatedName, with any counter and .gz, are counted.
+func (r *RotatingFile) pruneDated() error {
+	if r.conf.MaxFiles == 0 {
+		return nil
+	}
+
+	dir, base := filepath.Split(r.conf.RotatedName)
+	if dir == "" {
+		dir = "."
+	}
+	parts := loggenmunger.DatePattern.Split(base, -1)
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+	matcher, err := regexp.Compile(`^` + strings.Join(parts, `.+`) + `(\.\d+)?(\.gz)?$`)
+	if err != nil {
+		return err
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var rotated []os.FileInfo
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() && matcher.MatchString(entry.Name()) && filepath.Join(dir, entry.Name()) != filepath.Clean(r.path) {
+			rotated = append(rotated, entry)
+		}
+	}
+	if len(rotated) <= r.conf.MaxFiles {
+		return nil
+	}
+
+	sort.Slice(rotated, func(i, j int) bool { return rotated[i].ModTime().Before(rotated[j].ModTime()) })
+	for _, entry := range rotated[:len(rotated)-r.conf.MaxFiles] {
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies a file's contents to a new file
+func copyFile(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(to, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// gzipFile compresses a file to the same name with .gz on the end, and
+// removes the original
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	writer := gzip.NewWriter(out)
+	if _, err := io.Copy(writer, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,269 @@
+package loggensender
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// tempDir makes a directory for a test's files, and a func that removes it
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "gologgen")
+	if err != nil {
+		t.Fatalf("Failed case: couldn't make a temp dir: %v", err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// readFile reads a file, or a gzipped file if the name ends in .gz, and
+// returns "missing" if it's not there
+func readFile(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return "missing"
+	}
+	defer f.Close()
+
+	var body []byte
+	if strings.HasSuffix(path, ".gz") {
+		reader, err := gzip.NewReader(f)
+		if err != nil {
+			return "bad gzip"
+		}
+		body, _ = ioutil.ReadAll(reader)
+	} else {
+		body, _ = ioutil.ReadAll(f)
+	}
+	return string(body)
+}
+
+// lines makes each string a line to write
+func lines(texts ...string) [][]byte {
+	var out [][]byte
+	for _, text := range texts {
+		out = append(out, []byte(text+"\n"))
+	}
+	return out
+}
+
+// sizeMB is a size in bytes as MaxSizeMB
+func sizeMB(bytes int) float64 {
+	return float64(bytes) / (1024 * 1024)
+}
+
+func TestShiftNumbered(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	path := filepath.Join(dir, "app.log")
+	for _, name := range []string{"app.log.1", "app.log.2.gz", "app.log.3"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+	}
+
+	r := &RotatingFile{path: path, conf: FileOutputConf{RotatedName: path + ".{n}", MaxFiles: 2}}
+	rotated, err := r.shiftNumbered()
+	if err != nil || rotated != path+".1" {
+		t.Errorf("Failed case: {%s,nil} >> {%s,%v}", path+".1", rotated, err)
+	}
+
+	// The files past MaxFiles are gone, and .1 moved up to leave room for the current file
+	cases := []struct {
+		name string
+		want string
+	}{
+		{"app.log.1", "missing"},
+		{"app.log.2", "app.log.1"},
+		{"app.log.2.gz", "missing"},
+		{"app.log.3", "missing"},
+		{"app.log.3.gz", "missing"},
+	}
+	for _, c := range cases {
+		if got := readFile(filepath.Join(dir, c.name)); got != c.want {
+			t.Errorf("Failed case: %s: %s >> %s", c.name, c.want, got)
+		}
+	}
+}
+
+func TestPruneDated(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	path := filepath.Join(dir, "app.log")
+	r := &RotatingFile{path: path, conf: FileOutputConf{RotatedName: filepath.Join(dir, "app-%{+yyyyMMdd}.log"), MaxFiles: 2}}
+
+	// Oldest first. Only names that fit RotatedName count towards MaxFiles.
+	names := []string{"app-20160101.log", "app-20160102.log.1", "other.log", "app-20160103.log.gz", "app.log", "app-20160104.log.1.gz"}
+	base := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, name := range names {
+		file := filepath.Join(dir, name)
+		ioutil.WriteFile(file, []byte(name), 0644)
+		modTime := base.Add(time.Duration(i) * time.Hour)
+		os.Chtimes(file, modTime, modTime)
+	}
+
+	if err := r.pruneDated(); err != nil {
+		t.Errorf("Failed case: pruning >> %v", err)
+	}
+
+	cases := []struct {
+		name string
+		kept bool
+	}{
+		{"app-20160101.log", false},
+		{"app-20160102.log.1", false},
+		{"other.log", true},
+		{"app-20160103.log.gz", true},
+		{"app.log", true},
+		{"app-20160104.log.1.gz", true},
+	}
+	for _, c := range cases {
+		if got := fileExists(filepath.Join(dir, c.name)); got != c.kept {
+			t.Errorf("Failed case: %s kept: %v >> %v", c.name, c.kept, got)
+		}
+	}
+}
+
+func TestWriteLinesSize(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	path := filepath.Join(dir, "app.log")
+	r, err := OpenRotatingFile(path, FileOutputConf{MaxSizeMB: sizeMB(10)})
+	if err != nil {
+		t.Fatalf("Failed case: opening >> %v", err)
+	}
+	defer r.Close()
+
+	// Two lines fill the file exactly, the third rotates it, and a line bigger
+	// than MaxSizeMB still goes in a file of its own rather than being split
+	written, err := r.WriteLines(lines("aaaa", "bbbb", "cccc", "dddddddddddd"))
+	if err != nil || written != 4 {
+		t.Errorf("Failed case: {4,nil} >> {%d,%v}", written, err)
+	}
+
+	cases := []struct {
+		name string
+		want string
+	}{
+		{"app.log.2", "aaaa\nbbbb\n"},
+		{"app.log.1", "cccc\n"},
+		{"app.log", "dddddddddddd\n"},
+	}
+	for _, c := range cases {
+		if got := readFile(filepath.Join(dir, c.name)); got != c.want {
+			t.Errorf("Failed case: %s: %q >> %q", c.name, c.want, got)
+		}
+	}
+}
+
+func TestWriteLinesTime(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	path := filepath.Join(dir, "app.log")
+	r, err := OpenRotatingFile(path, FileOutputConf{RotateEvery: "1h"})
+	if err != nil {
+		t.Fatalf("Failed case: opening >> %v", err)
+	}
+	defer r.Close()
+
+	// Rotation is on the hour, not an hour after opening
+	now := time.Now()
+	if want := now.Truncate(time.Hour).Add(time.Hour); !r.nextRotate.Equal(want) && !r.nextRotate.Equal(want.Add(time.Hour)) {
+		t.Errorf("Failed case: next rotate %v >> %v", want, r.nextRotate)
+	}
+
+	r.WriteLines(lines("before"))
+	r.nextRotate = time.Now().Add(-time.Millisecond)
+	r.WriteLines(lines("after"))
+
+	if got := readFile(path + ".1"); got != "before\n" {
+		t.Errorf("Failed case: rotated %q >> %q", "before\n", got)
+	}
+	if got := readFile(path); got != "after\n" {
+		t.Errorf("Failed case: current %q >> %q", "after\n", got)
+	}
+	if !r.nextRotate.After(time.Now()) {
+		t.Errorf("Failed case: next rotate wasn't moved on after rotating, %v", r.nextRotate)
+	}
+}
+
+func TestWriteLinesCopyTruncateCompress(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	path := filepath.Join(dir, "app.log")
+	r, err := OpenRotatingFile(path, FileOutputConf{MaxSizeMB: sizeMB(10), CopyTruncate: true, Compress: true})
+	if err != nil {
+		t.Fatalf("Failed case: opening >> %v", err)
+	}
+	defer r.Close()
+	before, _ := os.Stat(path)
+
+	r.WriteLines(lines("aaaa", "bbbb", "cccc"))
+
+	// The file is copied aside and compressed, and the original is emptied in
+	// place so anything following it keeps the same file
+	after, _ := os.Stat(path)
+	if !os.SameFile(before, after) {
+		t.Errorf("Failed case: copytruncate replaced the file")
+	}
+	if got := readFile(path + ".1.gz"); got != "aaaa\nbbbb\n" {
+		t.Errorf("Failed case: rotated %q >> %q", "aaaa\nbbbb\n", got)
+	}
+	if fileExists(path + ".1") {
+		t.Errorf("Failed case: uncompressed rotated file was left behind")
+	}
+	if got := readFile(path); got != "cccc\n" {
+		t.Errorf("Failed case: current %q >> %q", "cccc\n", got)
+	}
+}
+
+func TestWriteLinesRotateFailure(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	// Rotated files go in a directory that doesn't exist, so rotating fails
+	path := filepath.Join(dir, "app.log")
+	conf := FileOutputConf{MaxSizeMB: sizeMB(5), RotateEvery: "1h", RotatedName: filepath.Join(dir, "missing", "app.{n}")}
+	r, err := OpenRotatingFile(path, conf)
+	if err != nil {
+		t.Fatalf("Failed case: opening >> %v", err)
+	}
+	defer r.Close()
+
+	r.nextRotate = time.Now().Add(-time.Millisecond)
+	written, err := r.WriteLines(lines("aaaa", "bbbb", "cccc"))
+	if err != nil || written != 3 {
+		t.Errorf("Failed case: {3,nil} >> {%d,%v}", written, err)
+	}
+
+	// The lines all go to the current file, rotating is tried once rather
+	// than for every line, and time rotation waits for the next interval
+	if got := readFile(path); got != "aaaa\nbbbb\ncccc\n" {
+		t.Errorf("Failed case: current %q >> %q", "aaaa\nbbbb\ncccc\n", got)
+	}
+	if got := strings.Count(logged.String(), "Failed to rotate"); got != 1 {
+		t.Errorf("Failed case: rotate tried 1 time >> %d", got)
+	}
+	if !r.nextRotate.After(time.Now()) {
+		t.Errorf("Failed case: next rotate wasn't moved on after failing, %v", r.nextRotate)
+	}
+
+	// The next write tries the size rotation again
+	r.WriteLines(lines("dddd"))
+	if got := strings.Count(logged.String(), "Failed to rotate"); got != 2 {
+		t.Errorf("Failed case: rotate tried 2 times >> %d", got)
+	}
+}
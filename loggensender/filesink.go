@@ -0,0 +1,316 @@
+package loggensender
+
+import (
+	"container/heap"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ftwynn/gologgen/loggenmunger"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// fileLine is a line waiting to be written to an output file
+type fileLine struct {
+	path        string
+	body        []byte
+	scheduledAt time.Time
+	arrival     uint64
+	targetRate  bool
+}
+
+// fileLineHeap orders waiting lines by when they were scheduled, and lines
+// scheduled at the same time by when they arrived
+type fileLineHeap []fileLine
+
+func (h fileLineHeap) Len() int { return len(h) }
+func (h fileLineHeap) Less(i, j int) bool {
+	if h[i].scheduledAt.Equal(h[j].scheduledAt) {
+		return h[i].arrival < h[j].arrival
+	}
+	return h[i].scheduledAt.Before(h[j].scheduledAt)
+}
+func (h fileLineHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *fileLineHeap) Push(x interface{}) { *h = append(*h, x.(fileLine)) }
+func (h *fileLineHeap) Pop() interface{} {
+	old := *h
+	line := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return line
+}
+
+// outputFile is an output file, the lines waiting to be written to it, and
+// how many times in a row writing them has failed. The file is nil when it's
+// not open. targetRate says which waiting lines were sent for the target rate.
+type outputFile struct {
+	file       *RotatingFile
+	pending    [][]byte
+	targetRate []bool
+	failures   int
+	lastUsed   time.Time
+}
+
+// files holds the running file output. One goroutine does all the writing:
+// senders hand it lines, it holds them for ReorderMillis so lines that were
+// sent out of order can be put back in the order they were scheduled, and
+// every FlushMillis it writes what's due to each file at once. Lines can
+// each go to their own path, so files are opened as they're needed, and the
+// least recently used is closed when too many are open.
+var files struct {
+	conf    FileOutputConf
+	lines   chan fileLine
+	stop    chan chan bool
+	outputs map[string]*outputFile
+	open    int
+
+	// Paths opened before, which are appended to if they're opened again
+	seen map[string]bool
+}
+
+// StartFileOutput sets up the file output and starts its writer. If path is
+// a plain file path, it's opened now so a bad path is found before anything
+// is generated.
+func StartFileOutput(path string, conf FileOutputConf) error {
+	if conf.MaxOpenFiles == 0 {
+		conf.MaxOpenFiles = defaultMaxOpenFiles
+	}
+	if conf.FlushMillis == 0 {
+		conf.FlushMillis = defaultFlushMillis
+	}
+	if conf.ReorderMillis == 0 {
+		conf.ReorderMillis = defaultReorderMillis
+	}
+	if conf.WriteRetries == 0 {
+		conf.WriteRetries = defaultWriteRetries
+	}
+
+	files.conf = conf
+	files.outputs = make(map[string]*outputFile)
+	files.seen = make(map[string]bool)
+
+	if path != "" && !strings.Contains(path, "$[") && !loggenmunger.DatePattern.MatchString(path) {
+		if err := openOutputFile(path, outputFileFor(path)); err != nil {
+			return err
+		}
+	}
+
+	files.lines = make(chan fileLine, defaultQueueSize)
+	files.stop = make(chan chan bool)
+	go runFileOutput()
+	return nil
+}
+
+// StopFileOutput writes every waiting line and closes the output files
+func StopFileOutput() {
+	if files.stop == nil {
+		return
+	}
+	done := make(chan bool)
+	files.stop <- done
+	<-done
+	files.stop = nil
+}
+
+// outputFilePath works out the path a line is written to. It can use
+// wildcards, and date parts like %{+yyyy-MM-dd} for when the line was made.
+func outputFilePath(params LogLineProperties) string {
+	scope := loggenmunger.TokenScope{LineID: params.LineID, SourceFile: params.SourceFile, Vars: params.Vars}
+	path := loggenmunger.RandomizeString(params.FilePath, params.TimestampFormat, scope)
+	return loggenmunger.FormatDatePattern(path, params.GeneratedAt)
+}
+
+// runFileOutput is the file output's writer
+func runFileOutput() {
+	flushInterval := time.Duration(files.conf.FlushMillis) * time.Millisecond
+	reorder := time.Duration(files.conf.ReorderMillis) * time.Millisecond
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var waiting fileLineHeap
+	var arrivals uint64
+	for {
+		select {
+		case line := <-files.lines:
+			line.arrival = arrivals
+			arrivals++
+			heap.Push(&waiting, line)
+
+		case now := <-ticker.C:
+			// Lines scheduled more than ReorderMillis ago are in order, since
+			// anything sent before them has had time to arrive
+			releaseFileLines(&waiting, now.Add(-reorder))
+			flushOutputFiles()
+
+		case done := <-files.stop:
+			// Take whatever was handed over before stopping too
+			for len(files.lines) > 0 {
+				line := <-files.lines
+				line.arrival = arrivals
+				arrivals++
+				heap.Push(&waiting, line)
+			}
+			for len(waiting) > 0 {
+				line := heap.Pop(&waiting).(fileLine)
+				outputFileFor(line.path).add(line)
+			}
+			flushOutputFiles()
+			for _, output := range files.outputs {
+				if output.file != nil {
+					output.file.Close()
+					output.file = nil
+				}
+			}
+			done <- true
+			return
+		}
+	}
+}
+
+// releaseFileLines moves the lines scheduled up to a time from waiting to
+// their files, in the order they were scheduled
+func releaseFileLines(waiting *fileLineHeap, until time.Time) {
+	for len(*waiting) > 0 && !(*waiting)[0].scheduledAt.After(until) {
+		line := heap.Pop(waiting).(fileLine)
+		outputFileFor(line.path).add(line)
+	}
+}
+
+// outputFileFor finds the output file for a path, without opening it
+func outputFileFor(path string) *outputFile {
+	output, ok := files.outputs[path]
+	if !ok {
+		output = &outputFile{}
+		files.outputs[path] = output
+	}
+	return output
+}
+
+// add puts a line at the end of the lines waiting to be written to the file
+func (output *outputFile) add(line fileLine) {
+	output.pending = append(output.pending, line.body)
+	output.targetRate = append(output.targetRate, line.targetRate)
+}
+
+// wrote takes the lines that were written off the front of the waiting
+// lines, and counts the target rate lines among them as sent
+func (output *outputFile) wrote(written int) {
+	for _, targetRate := range output.targetRate[:written] {
+		if targetRate {
+			atomic.AddInt64(&targetRateSent, 1)
+		}
+	}
+	output.pending = output.pending[written:]
+	output.targetRate = output.targetRate[written:]
+}
+
+// flushOutputFiles writes each file's waiting lines. Lines that can't be
+// written stay waiting and are tried again at the next flush, on a freshly
+// opened file, until WriteRetries flushes in a row have failed.
+func flushOutputFiles() {
+	for path, output := range files.outputs {
+		if len(output.pending) == 0 {
+			continue
+		}
+
+		written, err := writeOutputFile(path, output)
+		output.wrote(written)
+		if err == nil {
+			output.failures = 0
+			if files.conf.Fsync == "flush" {
+				if err := output.file.Sync(); err != nil {
+					log.WithFields(log.Fields{
+						"error_msg": err,
+						"path":      path,
+					}).Warn("Failed to sync the output file")
+				}
+			}
+			continue
+		}
+
+		output.failures++
+		if output.file != nil {
+			output.file.Close()
+			output.file = nil
+			files.open--
+		}
+		if output.failures < files.conf.WriteRetries {
+			log.WithFields(log.Fields{
+				"error_msg":     err,
+				"path":          path,
+				"lines":         len(output.pending),
+				"attemptNumber": output.failures,
+			}).Warn("Failed to write to the output file, retrying at the next flush")
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"error_msg": err,
+			"path":      path,
+			"lines":     len(output.pending),
+		}).Error("Failed to write to the output file and retries ran out, dropping lines")
+		output.pending = nil
+		output.targetRate = nil
+		output.failures = 0
+	}
+
+	// Forget files that are closed and have nothing waiting, so paths that
+	// change with the date don't pile up
+	for path, output := range files.outputs {
+		if output.file == nil && len(output.pending) == 0 {
+			delete(files.outputs, path)
+		}
+	}
+}
+
+// writeOutputFile writes a file's waiting lines, opening it first if need be
+func writeOutputFile(path string, output *outputFile) (int, error) {
+	if output.file == nil {
+		if err := openOutputFile(path, output); err != nil {
+			return 0, err
+		}
+	}
+	output.lastUsed = time.Now()
+	return output.file.WriteLines(output.pending)
+}
+
+// openOutputFile opens a file, making its directory if it's missing, and
+// closing the least recently used file first if too many are open. A file
+// is only emptied the first time it's opened, so one that was closed is
+// appended to.
+func openOutputFile(path string, output *outputFile) error {
+	if files.open >= files.conf.MaxOpenFiles {
+		var oldest *outputFile
+		for _, other := range files.outputs {
+			if other.file != nil && (oldest == nil || other.lastUsed.Before(oldest.lastUsed)) {
+				oldest = other
+			}
+		}
+		if oldest != nil {
+			oldest.file.Close()
+			oldest.file = nil
+			files.open--
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	conf := files.conf
+	if files.seen[path] {
+		conf.Append = true
+	}
+	file, err := OpenRotatingFile(path, conf)
+	if err != nil {
+		return err
+	}
+
+	files.seen[path] = true
+	output.file = file
+	output.lastUsed = time.Now()
+	files.open++
+	return nil
+}
@@ -0,0 +1,196 @@
+package loggensender
+
+import (
+	"bytes"
+	"container/heap"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// resetFiles sets up the file output's state without starting its writer,
+// so flushes can be run by hand
+func resetFiles(conf FileOutputConf) {
+	files.conf = conf
+	files.outputs = make(map[string]*outputFile)
+	files.seen = make(map[string]bool)
+	files.open = 0
+}
+
+// closeFiles closes the output files a test opened
+func closeFiles() {
+	for _, output := range files.outputs {
+		if output.file != nil {
+			output.file.Close()
+		}
+	}
+}
+
+// addLines puts lines in a file's waiting lines. Lines in targetRate were
+// sent for the target rate.
+func addLines(path string, targetRate bool, texts ...string) {
+	for _, body := range lines(texts...) {
+		outputFileFor(path).add(fileLine{path: path, body: body, targetRate: targetRate})
+	}
+}
+
+func TestFileLineHeapOrder(t *testing.T) {
+	base := time.Now()
+	at := func(millis int) time.Time { return base.Add(time.Duration(millis) * time.Millisecond) }
+
+	// Lines scheduled at the same time stay in the order they arrived
+	var waiting fileLineHeap
+	pushed := []fileLine{
+		{body: []byte("c"), scheduledAt: at(20), arrival: 0},
+		{body: []byte("a"), scheduledAt: at(0), arrival: 1},
+		{body: []byte("d"), scheduledAt: at(20), arrival: 2},
+		{body: []byte("b"), scheduledAt: at(10), arrival: 3},
+	}
+	for _, line := range pushed {
+		heap.Push(&waiting, line)
+	}
+
+	var got string
+	for len(waiting) > 0 {
+		got += string(heap.Pop(&waiting).(fileLine).body)
+	}
+	if got != "abcd" {
+		t.Errorf("Failed case: %s >> %s", "abcd", got)
+	}
+}
+
+func TestFileOutputReorder(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	path := filepath.Join(dir, "app.log")
+	resetFiles(FileOutputConf{MaxOpenFiles: 4, WriteRetries: 1})
+	defer closeFiles()
+
+	// The later line arrives first, and each is held until it's due
+	base := time.Now()
+	var waiting fileLineHeap
+	heap.Push(&waiting, fileLine{path: path, body: []byte("second\n"), scheduledAt: base.Add(time.Millisecond), arrival: 0})
+	heap.Push(&waiting, fileLine{path: path, body: []byte("first\n"), scheduledAt: base, arrival: 1})
+
+	cases := []struct {
+		until time.Time
+		want  string
+	}{
+		{base.Add(-time.Millisecond), "missing"},
+		{base, "first\n"},
+		{base.Add(time.Millisecond), "first\nsecond\n"},
+	}
+	for _, c := range cases {
+		releaseFileLines(&waiting, c.until)
+		flushOutputFiles()
+		if got := readFile(path); got != c.want {
+			t.Errorf("Failed case: until %v: %q >> %q", c.until.Sub(base), c.want, got)
+		}
+	}
+}
+
+func TestStopFileOutput(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	// Lines still on their way to the writer, and lines it's holding back
+	// for ReorderMillis, are all written when it stops
+	path := filepath.Join(dir, "app.log")
+	if err := StartFileOutput(path, FileOutputConf{FlushMillis: 60000, ReorderMillis: 60000}); err != nil {
+		t.Fatalf("Failed case: starting >> %v", err)
+	}
+	now := time.Now()
+	files.lines <- fileLine{path: path, body: []byte("second\n"), scheduledAt: now.Add(time.Millisecond)}
+	files.lines <- fileLine{path: path, body: []byte("first\n"), scheduledAt: now}
+	StopFileOutput()
+
+	if got := readFile(path); got != "first\nsecond\n" {
+		t.Errorf("Failed case: %q >> %q", "first\nsecond\n", got)
+	}
+}
+
+func TestFileOutputRetryThenDrop(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	// The file's directory is a file, so it can't be opened
+	blocker := filepath.Join(dir, "blocker")
+	ioutil.WriteFile(blocker, nil, 0644)
+	path := filepath.Join(blocker, "app.log")
+
+	resetFiles(FileOutputConf{MaxOpenFiles: 4, WriteRetries: 3})
+	addLines(path, true, "one", "two")
+	sent := TargetRateSent()
+
+	for attempt := 1; attempt < 3; attempt++ {
+		flushOutputFiles()
+		output, ok := files.outputs[path]
+		if !ok || len(output.pending) != 2 || output.failures != attempt {
+			t.Fatalf("Failed case: lines weren't kept for retry %d", attempt)
+		}
+	}
+
+	flushOutputFiles()
+	if _, ok := files.outputs[path]; ok {
+		t.Errorf("Failed case: lines weren't dropped once retries ran out")
+	}
+	if got := strings.Count(logged.String(), "retrying at the next flush"); got != 2 {
+		t.Errorf("Failed case: retried 2 times >> %d", got)
+	}
+	if got := strings.Count(logged.String(), "retries ran out"); got != 1 {
+		t.Errorf("Failed case: dropped 1 time >> %d", got)
+	}
+	if got := TargetRateSent() - sent; got != 0 {
+		t.Errorf("Failed case: dropped lines counted as sent, %d", got)
+	}
+}
+
+func TestFileOutputEviction(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	first := filepath.Join(dir, "first.log")
+	second := filepath.Join(dir, "second.log")
+	resetFiles(FileOutputConf{MaxOpenFiles: 1, WriteRetries: 1})
+
+	sent := TargetRateSent()
+	addLines(first, true, "one")
+	flushOutputFiles()
+
+	// Opening the second file closes the first, which is then forgotten
+	addLines(second, false, "two")
+	flushOutputFiles()
+	if _, ok := files.outputs[first]; ok || files.open != 1 {
+		t.Errorf("Failed case: {evicted,1 open} >> {%v,%d open}", !ok, files.open)
+	}
+
+	// Going back to the first file appends to it rather than emptying it
+	addLines(first, true, "three")
+	flushOutputFiles()
+	if files.open != 1 {
+		t.Errorf("Failed case: 1 open >> %d open", files.open)
+	}
+
+	// Only the written lines sent for the target rate are counted
+	if got := TargetRateSent() - sent; got != 2 {
+		t.Errorf("Failed case: 2 target rate lines sent >> %d", got)
+	}
+
+	closeFiles()
+	if got := readFile(first); got != "one\nthree\n" {
+		t.Errorf("Failed case: %q >> %q", "one\nthree\n", got)
+	}
+	if got := readFile(second); got != "two\n" {
+		t.Errorf("Failed case: %q >> %q", "two\n", got)
+	}
+}
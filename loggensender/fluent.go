@@ -0,0 +1,459 @@
+package loggensender
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ftwynn/gologgen/loggenmunger"
+	"github.com/vmihailenco/msgpack/v5"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// FluentConf holds the settings for the Fluent forward protocol output
+type FluentConf struct {
+	Network          string  `json:"Network"`
+	Address          string  `json:"Address"`
+	Tag              string  `json:"Tag"`
+	Mode             string  `json:"Mode"`
+	Compression      string  `json:"Compression"`
+	MessageField     string  `json:"MessageField"`
+	RequireAck       bool    `json:"RequireAck"`
+	AckTimeoutMillis int     `json:"AckTimeoutMillis"`
+	SharedKey        string  `json:"SharedKey"`
+	Hostname         string  `json:"Hostname"`
+	Username         string  `json:"Username"`
+	Password         string  `json:"Password"`
+	BatchSize        int     `json:"BatchSize"`
+	BatchMillis      int     `json:"BatchMillis"`
+	TLS              TLSConf `json:"TLS"`
+}
+
+// fluentEntry is one event: its time and its record
+type fluentEntry struct {
+	time   fluentEventTime
+	record map[string]interface{}
+}
+
+// fluentEventTime is the forward protocol's EventTime, a msgpack extension
+// with the seconds and nanoseconds, so events keep sub-second times
+type fluentEventTime time.Time
+
+// EncodeMsgpack writes the time as extension type 0
+func (t fluentEventTime) EncodeMsgpack(enc *msgpack.Encoder) error {
+	if err := enc.EncodeExtHeader(0, 8); err != nil {
+		return err
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint32(buf[:4], uint32(time.Time(t).Unix()))
+	binary.BigEndian.PutUint32(buf[4:], uint32(time.Time(t).Nanosecond()))
+	_, err := enc.Writer().Write(buf[:])
+	return err
+}
+
+// Defaults for the Fluent output
+const (
+	defaultFluentNetwork      = "tcp"
+	defaultFluentTag          = "gologgen"
+	defaultFluentMode         = "forward"
+	defaultFluentMessageField = "message"
+	defaultFluentAckTimeout   = 30000
+	fluentRetries             = 3
+	fluentTimeout             = 30 * time.Second
+)
+
+// fluent holds the running Fluent output. Everything written to the
+// connection goes through the mutex, so acks match up with their chunks.
+var fluent struct {
+	conf      FluentConf
+	tlsConfig *tls.Config
+	batcher   *batcher
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// ValidateFluentConf checks the Fluent settings before anything is sent
+func ValidateFluentConf(conf FluentConf) error {
+	switch conf.Network {
+	case "", "tcp":
+		if _, _, err := net.SplitHostPort(conf.Address); err != nil {
+			return errors.New("Fluent Address must be in the form host:port for tcp: " + conf.Address)
+		}
+	case "unix":
+		if conf.Address == "" {
+			return errors.New("Fluent Address must be the socket path for unix")
+		}
+		if conf.TLS.Enabled {
+			return errors.New("Fluent TLS is only for tcp")
+		}
+	default:
+		return errors.New("Fluent Network must be in (tcp, unix): " + conf.Network)
+	}
+	if conf.Mode != "" && conf.Mode != "message" && conf.Mode != "forward" && conf.Mode != "packedforward" {
+		return errors.New("Fluent Mode must be in (message, forward, packedforward): " + conf.Mode)
+	}
+	if conf.Compression != "" && conf.Compression != "none" && conf.Compression != "gzip" {
+		return errors.New("Fluent Compression must be in (none, gzip): " + conf.Compression)
+	}
+	if conf.Compression == "gzip" && conf.Mode != "packedforward" {
+		return errors.New("Fluent gzip Compression is only for the packedforward Mode")
+	}
+	if conf.Username != "" && conf.SharedKey == "" {
+		return errors.New("Fluent Username needs a SharedKey, as user auth is part of the handshake")
+	}
+	if conf.BatchSize < 0 || conf.BatchMillis < 0 || conf.AckTimeoutMillis < 0 {
+		return errors.New("Fluent BatchSize, BatchMillis and AckTimeoutMillis cannot be negative")
+	}
+	return nil
+}
+
+// StartFluent sets up the Fluent output. The connection is made, with the
+// handshake if there's a SharedKey, when the first events are sent.
+func StartFluent(conf FluentConf) error {
+	if conf.Network == "" {
+		conf.Network = defaultFluentNetwork
+	}
+	if conf.Tag == "" {
+		conf.Tag = defaultFluentTag
+	}
+	if conf.Mode == "" {
+		conf.Mode = defaultFluentMode
+	}
+	if conf.MessageField == "" {
+		conf.MessageField = defaultFluentMessageField
+	}
+	if conf.AckTimeoutMillis == 0 {
+		conf.AckTimeoutMillis = defaultFluentAckTimeout
+	}
+	if conf.Hostname == "" {
+		conf.Hostname, _ = os.Hostname()
+	}
+
+	if conf.TLS.Enabled {
+		tlsConfig, err := conf.TLS.Config()
+		if err != nil {
+			return err
+		}
+		fluent.tlsConfig = tlsConfig
+	}
+
+	fluent.conf = conf
+	if conf.Mode != "message" {
+		fluent.batcher = newBatcher(conf.BatchSize, conf.BatchMillis, flushFluent)
+	}
+
+	return nil
+}
+
+// sendLogLineFluent sends the log line as a Fluent event. In the message
+// Mode each line goes on its own, and otherwise lines are batched by tag.
+func sendLogLineFluent(stringBody []byte, params LogLineProperties) {
+	if fluent.conf.Address == "" {
+		log.Error("Fluent output used without Fluent settings in the global conf, dropping line")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"line": string(stringBody),
+	}).Info("Sending log to Fluent")
+
+	if fluent.batcher != nil {
+		fluent.batcher.add(stringBody, params)
+		return
+	}
+
+	tag := fluentTag(params)
+	entry := fluentRecord(stringBody, params)
+	if sendFluent(tag, 1, func(option map[string]interface{}) []interface{} {
+		return []interface{}{tag, entry.time, entry.record, option}
+	}) {
+		countSent(params)
+	}
+}
+
+// fluentTag works out a line's tag, rendering any wildcards in it
+func fluentTag(params LogLineProperties) string {
+	tag := params.FluentTag
+	if tag == "" {
+		tag = fluent.conf.Tag
+	}
+	scope := loggenmunger.TokenScope{LineID: params.LineID, SourceFile: params.SourceFile, Vars: params.Vars}
+	return loggenmunger.RandomizeString(tag, params.TimestampFormat, scope)
+}
+
+// fluentRecord turns a line into an event. JSON object lines become the
+// record as they are, and anything else goes in the message field.
+func fluentRecord(stringBody []byte, params LogLineProperties) fluentEntry {
+	entry := fluentEntry{time: fluentEventTime(params.GeneratedAt)}
+	if bytes.HasPrefix(stringBody, []byte("{")) && json.Unmarshal(stringBody, &entry.record) == nil {
+		return entry
+	}
+	entry.record = map[string]interface{}{fluent.conf.MessageField: string(stringBody)}
+	return entry
+}
+
+// flushFluent sends a batch of lines, one Forward or PackedForward message per tag
+func flushFluent(lines []queuedLine) {
+	tags := make(map[string][]fluentEntry)
+	tagLines := make(map[string][]queuedLine)
+	var order []string
+	for _, line := range lines {
+		tag := fluentTag(line.params)
+		if _, ok := tags[tag]; !ok {
+			order = append(order, tag)
+		}
+		tags[tag] = append(tags[tag], fluentRecord(line.body, line.params))
+		tagLines[tag] = append(tagLines[tag], line)
+	}
+
+	for _, tag := range order {
+		entries := tags[tag]
+		if fluent.conf.Mode == "forward" {
+			events := make([]interface{}, len(entries))
+			for i, entry := range entries {
+				events[i] = []interface{}{entry.time, entry.record}
+			}
+			if sendFluent(tag, len(entries), func(option map[string]interface{}) []interface{} {
+				return []interface{}{tag, events, option}
+			}) {
+				countSentLines(tagLines[tag])
+			}
+			continue
+		}
+
+		// PackedForward sends the events as one msgpack stream in a bin
+		var stream bytes.Buffer
+		var encoded []queuedLine
+		encoder := msgpack.NewEncoder(&stream)
+		for i, entry := range entries {
+			if err := encoder.Encode([]interface{}{entry.time, entry.record}); err != nil {
+				log.WithFields(log.Fields{
+					"error_msg": err,
+				}).Error("Couldn't encode the Fluent event, dropping it")
+				continue
+			}
+			encoded = append(encoded, tagLines[tag][i])
+		}
+		packed := stream.Bytes()
+		if fluent.conf.Compression == "gzip" {
+			var compressed bytes.Buffer
+			writer := gzip.NewWriter(&compressed)
+			writer.Write(packed)
+			writer.Close()
+			packed = compressed.Bytes()
+		}
+
+		if sendFluent(tag, len(entries), func(option map[string]interface{}) []interface{} {
+			option["size"] = len(entries)
+			if fluent.conf.Compression == "gzip" {
+				option["compressed"] = "gzip"
+			}
+			return []interface{}{tag, packed, option}
+		}) {
+			countSentLines(encoded)
+		}
+	}
+}
+
+// sendFluent sends one message, built by build with the options it should
+// carry, and waits for its ack if RequireAck is on. The connection is
+// redialed and the message tried again if anything goes wrong. It says
+// whether the message was sent.
+func sendFluent(tag string, count int, build func(option map[string]interface{}) []interface{}) bool {
+	fluent.mu.Lock()
+	defer fluent.mu.Unlock()
+
+	for attempt := 1; attempt <= fluentRetries; attempt++ {
+		option := make(map[string]interface{})
+		var chunk string
+		if fluent.conf.RequireAck {
+			id := make([]byte, 16)
+			rand.Read(id)
+			chunk = base64.StdEncoding.EncodeToString(id)
+			option["chunk"] = chunk
+		}
+
+		message, err := msgpack.Marshal(build(option))
+		if err == nil {
+			err = writeFluent(message, chunk)
+		}
+		if err == nil {
+			log.WithFields(log.Fields{
+				"tag":    tag,
+				"events": count,
+			}).Debug("Fluent events sent")
+			return true
+		}
+
+		if fluent.conn != nil {
+			fluent.conn.Close()
+			fluent.conn = nil
+		}
+		log.WithFields(log.Fields{
+			"error_msg":     err,
+			"tag":           tag,
+			"attemptNumber": attempt,
+		}).Warn("Fluent send failed, retrying")
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+
+	log.WithFields(log.Fields{
+		"tag":    tag,
+		"events": count,
+	}).Error("Fluent send failed and retries ran out, dropping events")
+	return false
+}
+
+// writeFluent writes a message on the connection, dialing first if need
+// be, and checks the ack when there's a chunk ID
+func writeFluent(message []byte, chunk string) error {
+	if fluent.conn == nil {
+		conn, err := dialFluent()
+		if err != nil {
+			return err
+		}
+		fluent.conn = conn
+	}
+
+	fluent.conn.SetWriteDeadline(time.Now().Add(fluentTimeout))
+	if _, err := fluent.conn.Write(message); err != nil {
+		return err
+	}
+	if chunk == "" {
+		return nil
+	}
+
+	fluent.conn.SetReadDeadline(time.Now().Add(time.Duration(fluent.conf.AckTimeoutMillis) * time.Millisecond))
+	var response map[string]interface{}
+	if err := msgpack.NewDecoder(fluent.conn).Decode(&response); err != nil {
+		return errors.New("No ack from Fluent: " + err.Error())
+	}
+	if fluentString(response["ack"]) != chunk {
+		return errors.New("Fluent acked a different chunk than the one sent")
+	}
+	return nil
+}
+
+// dialFluent connects to the Fluent input, and does the shared key
+// handshake if there's a SharedKey
+func dialFluent() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: fluentTimeout}
+	var conn net.Conn
+	var err error
+	if fluent.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, fluent.conf.Network, fluent.conf.Address, fluent.tlsConfig)
+	} else {
+		conn, err = dialer.Dial(fluent.conf.Network, fluent.conf.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if fluent.conf.SharedKey != "" {
+		conn.SetDeadline(time.Now().Add(fluentTimeout))
+		if err := fluentHandshake(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+	}
+
+	return conn, nil
+}
+
+// fluentHandshake answers the server's HELO with a PING proving we know the
+// shared key (and the password, if the server wants user auth), then checks
+// the server's PONG proves it knows the shared key too
+func fluentHandshake(conn net.Conn) error {
+	decoder := msgpack.NewDecoder(conn)
+
+	var helo []interface{}
+	if err := decoder.Decode(&helo); err != nil {
+		return errors.New("No HELO from Fluent: " + err.Error())
+	}
+	if len(helo) < 2 || fluentString(helo[0]) != "HELO" {
+		return errors.New("Fluent didn't start the handshake with HELO")
+	}
+	heloOptions, _ := helo[1].(map[string]interface{})
+	nonce := fluentString(heloOptions["nonce"])
+	authSalt := fluentString(heloOptions["auth"])
+
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	sharedKeySalt := hex.EncodeToString(salt)
+
+	username, passwordDigest := "", ""
+	if authSalt != "" {
+		username = fluent.conf.Username
+		passwordDigest = fluentDigest(authSalt, fluent.conf.Username, fluent.conf.Password)
+	}
+
+	ping, err := msgpack.Marshal([]interface{}{
+		"PING",
+		fluent.conf.Hostname,
+		sharedKeySalt,
+		fluentDigest(sharedKeySalt, fluent.conf.Hostname, nonce, fluent.conf.SharedKey),
+		username,
+		passwordDigest,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(ping); err != nil {
+		return err
+	}
+
+	var pong []interface{}
+	if err := decoder.Decode(&pong); err != nil {
+		return errors.New("No PONG from Fluent: " + err.Error())
+	}
+	if len(pong) < 5 || fluentString(pong[0]) != "PONG" {
+		return errors.New("Fluent didn't answer the PING with PONG")
+	}
+	if ok, _ := pong[1].(bool); !ok {
+		return errors.New("Fluent refused the handshake: " + fluentString(pong[2]))
+	}
+	if fluentString(pong[4]) != fluentDigest(sharedKeySalt, fluentString(pong[3]), nonce, fluent.conf.SharedKey) {
+		return errors.New("Fluent server doesn't know the shared key")
+	}
+
+	return nil
+}
+
+// fluentDigest is the hex SHA-512 of the parts joined together, as the
+// handshake uses for its proofs
+func fluentDigest(parts ...string) string {
+	hash := sha512.New()
+	for _, part := range parts {
+		hash.Write([]byte(part))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// fluentString reads a msgpack value that could be a str or a bin as a string
+func fluentString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
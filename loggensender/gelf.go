@@ -0,0 +1,386 @@
+package loggensender
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ftwynn/gologgen/loggenmunger"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// GELFConf holds the settings for the Graylog GELF output
+type GELFConf struct {
+	Transport   string  `json:"Transport"`
+	Address     string  `json:"Address"`
+	Host        string  `json:"Host"`
+	Level       string  `json:"Level"`
+	Compression string  `json:"Compression"`
+	ChunkSize   int     `json:"ChunkSize"`
+	TLS         TLSConf `json:"TLS"`
+}
+
+// GELFLine is the per-line GELF settings. Level and the Fields' values can
+// use wildcards.
+type GELFLine struct {
+	Level  string            `json:"Level"`
+	Fields map[string]string `json:"Fields"`
+}
+
+// Defaults and limits for the GELF output
+const (
+	defaultGELFTransport = "udp"
+	defaultGELFLevel     = "6"
+	defaultGELFChunkSize = 1420
+	gelfMaxChunks        = 128
+	gelfChunkHeaderSize  = 12
+	gelfTimeout          = 30 * time.Second
+)
+
+// gelfFieldName is what GELF allows in an additional field name
+var gelfFieldName = regexp.MustCompile(`^[\w\.\-]+$`)
+
+// gelfNumber is a plain decimal number, which is sent as a JSON number. Things
+// Go would also parse as a float, like NaN, Inf, hex and exponents, aren't.
+var gelfNumber = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?$`)
+
+// gelf holds the running GELF output
+var gelf struct {
+	conf   GELFConf
+	client *http.Client
+	udp    net.Conn
+
+	// The TCP connection is shared by every sender, and redialed when it breaks
+	tcpMu     sync.Mutex
+	tcp       net.Conn
+	tlsConfig *tls.Config
+}
+
+// ValidateGELFConf checks the GELF settings before anything is sent
+func ValidateGELFConf(conf GELFConf) error {
+	switch conf.Transport {
+	case "", "udp", "tcp":
+		if _, _, err := net.SplitHostPort(conf.Address); err != nil {
+			return errors.New("GELF Address must be in the form host:port for udp and tcp: " + conf.Address)
+		}
+	case "http":
+		if !strings.HasPrefix(conf.Address, "http://") && !strings.HasPrefix(conf.Address, "https://") {
+			return errors.New("GELF Address must start with http:// or https:// for http")
+		}
+	default:
+		return errors.New("GELF Transport must be in (udp, tcp, http): " + conf.Transport)
+	}
+
+	switch conf.Compression {
+	case "", "none":
+	case "gzip":
+		if conf.Transport == "tcp" {
+			return errors.New("GELF over tcp can't be compressed")
+		}
+	case "zlib":
+		if conf.Transport == "tcp" || conf.Transport == "http" {
+			return errors.New("GELF zlib Compression is only for udp")
+		}
+	default:
+		return errors.New("GELF Compression must be in (none, gzip, zlib): " + conf.Compression)
+	}
+
+	if conf.ChunkSize != 0 && conf.ChunkSize <= gelfChunkHeaderSize {
+		return errors.New("GELF ChunkSize must be more than the 12 byte chunk header")
+	}
+	return validateGELFLevel(conf.Level)
+}
+
+// ValidateGELFLine checks a line's GELF settings
+func ValidateGELFLine(line GELFLine) error {
+	for name := range line.Fields {
+		if !gelfFieldName.MatchString(name) || name == "id" {
+			return errors.New("GELF Fields names must be letters, digits, underscores, dashes and dots, and not id: " + name)
+		}
+	}
+	return validateGELFLevel(line.Level)
+}
+
+// validateGELFLevel checks a level is a syslog level, unless it uses
+// wildcards and can only be known when the line is sent
+func validateGELFLevel(level string) error {
+	if level == "" || strings.Contains(level, "$[") {
+		return nil
+	}
+	if value, err := strconv.Atoi(level); err != nil || value < 0 || value > 7 {
+		return errors.New("GELF Level must be a syslog level from 0 to 7: " + level)
+	}
+	return nil
+}
+
+// StartGELF sets up the GELF connection or client
+func StartGELF(conf GELFConf) error {
+	if conf.Transport == "" {
+		conf.Transport = defaultGELFTransport
+	}
+	if conf.Host == "" {
+		conf.Host, _ = os.Hostname()
+	}
+	if conf.Level == "" {
+		conf.Level = defaultGELFLevel
+	}
+	if conf.Compression == "" && conf.Transport == "udp" {
+		conf.Compression = "gzip"
+	}
+	if conf.ChunkSize == 0 {
+		conf.ChunkSize = defaultGELFChunkSize
+	}
+
+	var tlsConfig *tls.Config
+	if conf.TLS.Enabled {
+		var err error
+		tlsConfig, err = conf.TLS.Config()
+		if err != nil {
+			return err
+		}
+	}
+
+	switch conf.Transport {
+	case "udp":
+		conn, err := net.Dial("udp", conf.Address)
+		if err != nil {
+			return err
+		}
+		gelf.udp = conn
+	case "tcp":
+		gelf.tlsConfig = tlsConfig
+	case "http":
+		gelf.client = &http.Client{Timeout: gelfTimeout}
+		if tlsConfig != nil {
+			gelf.client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+		}
+	}
+
+	gelf.conf = conf
+	return nil
+}
+
+// sendLogLineGELF sends the log line to Graylog as a GELF message
+func sendLogLineGELF(stringBody []byte, params LogLineProperties) {
+	if gelf.conf.Address == "" {
+		log.Error("GELF output used without GELF settings in the global conf, dropping line")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"line":      string(stringBody),
+		"transport": gelf.conf.Transport,
+	}).Info("Sending log to GELF")
+
+	message, err := json.Marshal(gelfMessage(stringBody, params))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error_msg": err,
+			"line":      string(stringBody),
+		}).Error("Couldn't build the GELF message, dropping line")
+		return
+	}
+
+	switch gelf.conf.Transport {
+	case "udp":
+		err = sendGELFUDP(message)
+	case "tcp":
+		err = sendGELFTCP(message)
+	case "http":
+		err = sendGELFHTTP(message)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error_msg": err,
+			"transport": gelf.conf.Transport,
+			"address":   gelf.conf.Address,
+		}).Error("Failed to send GELF message, dropping line")
+		return
+	}
+	countSent(params)
+}
+
+// gelfMessage builds a GELF 1.1 message. The first line of the text is the
+// short message, and text with more than one line is also the full message.
+func gelfMessage(stringBody []byte, params LogLineProperties) map[string]interface{} {
+	scope := loggenmunger.TokenScope{LineID: params.LineID, SourceFile: params.SourceFile, Vars: params.Vars}
+
+	text := string(stringBody)
+	short := text
+	if newline := strings.IndexByte(text, '\n'); newline >= 0 {
+		short = text[:newline]
+	}
+
+	level := params.GELF.Level
+	if level == "" {
+		level = gelf.conf.Level
+	}
+	levelNumber, err := strconv.Atoi(loggenmunger.RandomizeString(level, params.TimestampFormat, scope))
+	if err != nil || levelNumber < 0 || levelNumber > 7 {
+		levelNumber, _ = strconv.Atoi(defaultGELFLevel)
+	}
+
+	message := map[string]interface{}{
+		"version":       "1.1",
+		"host":          loggenmunger.RandomizeString(gelf.conf.Host, params.TimestampFormat, scope),
+		"short_message": short,
+		"timestamp":     json.Number(strconv.FormatFloat(float64(params.GeneratedAt.UnixNano())/1e9, 'f', 3, 64)),
+		"level":         levelNumber,
+	}
+	if short != text {
+		message["full_message"] = text
+	}
+
+	// Numbers are sent as numbers so Graylog can do math on them
+	for name, value := range params.GELF.Fields {
+		value = loggenmunger.RandomizeString(value, params.TimestampFormat, scope)
+		if gelfNumber.MatchString(value) {
+			message["_"+name] = json.Number(value)
+		} else {
+			message["_"+name] = value
+		}
+	}
+
+	return message
+}
+
+// gelfCompress compresses a message with the configured compression
+func gelfCompress(message []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	var writer io.WriteCloser
+	switch gelf.conf.Compression {
+	case "gzip":
+		writer = gzip.NewWriter(&compressed)
+	case "zlib":
+		writer = zlib.NewWriter(&compressed)
+	default:
+		return message, nil
+	}
+
+	if _, err := writer.Write(message); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+// sendGELFUDP sends a message in one datagram, or in chunks if it's bigger
+// than ChunkSize
+func sendGELFUDP(message []byte) error {
+	message, err := gelfCompress(message)
+	if err != nil {
+		return err
+	}
+
+	if len(message) <= gelf.conf.ChunkSize {
+		_, err = gelf.udp.Write(message)
+		return err
+	}
+
+	dataSize := gelf.conf.ChunkSize - gelfChunkHeaderSize
+	count := (len(message) + dataSize - 1) / dataSize
+	if count > gelfMaxChunks {
+		return errors.New("GELF message needs " + strconv.Itoa(count) + " chunks, more than the 128 allowed")
+	}
+
+	// Every chunk has the magic bytes, the message ID, its number and the count
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	for i := 0; i < count; i++ {
+		end := (i + 1) * dataSize
+		if end > len(message) {
+			end = len(message)
+		}
+
+		chunk := make([]byte, 0, gelfChunkHeaderSize+end-i*dataSize)
+		chunk = append(chunk, 0x1e, 0x0f)
+		chunk = append(chunk, id...)
+		chunk = append(chunk, byte(i), byte(count))
+		chunk = append(chunk, message[i*dataSize:end]...)
+
+		if _, err := gelf.udp.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendGELFTCP sends a message ended with a null byte, dialing again and
+// trying once more if the connection has broken
+func sendGELFTCP(message []byte) error {
+	gelf.tcpMu.Lock()
+	defer gelf.tcpMu.Unlock()
+
+	frame := append(message, 0)
+	var err error
+	for attempt := 1; attempt <= 2; attempt++ {
+		if gelf.tcp == nil {
+			dialer := &net.Dialer{Timeout: gelfTimeout}
+			if gelf.tlsConfig != nil {
+				gelf.tcp, err = tls.DialWithDialer(dialer, "tcp", gelf.conf.Address, gelf.tlsConfig)
+			} else {
+				gelf.tcp, err = dialer.Dial("tcp", gelf.conf.Address)
+			}
+			if err != nil {
+				gelf.tcp = nil
+				continue
+			}
+		}
+
+		gelf.tcp.SetWriteDeadline(time.Now().Add(gelfTimeout))
+		if _, err = gelf.tcp.Write(frame); err == nil {
+			return nil
+		}
+		gelf.tcp.Close()
+		gelf.tcp = nil
+	}
+	return err
+}
+
+// sendGELFHTTP POSTs a message, gzipped if Compression is gzip
+func sendGELFHTTP(message []byte) error {
+	body, err := gelfCompress(message)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", gelf.conf.Address, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if gelf.conf.Compression == "gzip" {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	resp, err := gelf.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		reply, _ := ioutil.ReadAll(resp.Body)
+		return errors.New("GELF endpoint responded " + resp.Status + ": " + string(reply))
+	}
+	return nil
+}
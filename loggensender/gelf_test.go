@@ -0,0 +1,45 @@
+package loggensender
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestGELFMessageFields(t *testing.T) {
+	cases := []struct {
+		value string
+		want  string
+	}{
+		{"42", `42`},
+		{"-3.25", `-3.25`},
+		{"0", `0`},
+		{"0.5", `0.5`},
+		{"007", `"007"`},
+		{"NaN", `"NaN"`},
+		{"inf", `"inf"`},
+		{"-Infinity", `"-Infinity"`},
+		{"0x1p-2", `"0x1p-2"`},
+		{"1e3", `"1e3"`},
+		{"1.", `"1."`},
+		{"abc", `"abc"`},
+	}
+
+	for _, c := range cases {
+		params := LogLineProperties{
+			GeneratedAt: time.Unix(0, 0),
+			GELF:        GELFLine{Fields: map[string]string{"value": c.value}},
+		}
+		body, err := json.Marshal(gelfMessage([]byte("line"), params))
+		if err != nil {
+			t.Errorf("Failed case: %q >> %v", c.value, err)
+			continue
+		}
+
+		var message map[string]json.RawMessage
+		json.Unmarshal(body, &message)
+		if got := string(message["_value"]); got != c.want {
+			t.Errorf("Failed case: %q: %s >> %s", c.value, c.want, got)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package loggensender
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ftwynn/gologgen/loggenmunger"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// HECConf holds the settings for the Splunk HTTP Event Collector output
+type HECConf struct {
+	URL           string  `json:"URL"`
+	Token         string  `json:"Token"`
+	Endpoint      string  `json:"Endpoint"`
+	Channel       string  `json:"Channel"`
+	Host          string  `json:"Host"`
+	Source        string  `json:"Source"`
+	Sourcetype    string  `json:"Sourcetype"`
+	Index         string  `json:"Index"`
+	BatchSize     int     `json:"BatchSize"`
+	BatchMillis   int     `json:"BatchMillis"`
+	UseAck        bool    `json:"UseAck"`
+	AckPollMillis int     `json:"AckPollMillis"`
+	TLS           TLSConf `json:"TLS"`
+}
+
+// HECMeta is the per-line metadata for HEC events. Blank values fall back
+// to the HEC settings in the global conf.
+type HECMeta struct {
+	Host       string            `json:"Host"`
+	Source     string            `json:"Source"`
+	Sourcetype string            `json:"Sourcetype"`
+	Index      string            `json:"Index"`
+	Fields     map[string]string `json:"Fields"`
+}
+
+// hecEvent is the JSON envelope the event endpoint expects
+type hecEvent struct {
+	Time       json.Number       `json:"time"`
+	Host       string            `json:"host,omitempty"`
+	Source     string            `json:"source,omitempty"`
+	Sourcetype string            `json:"sourcetype,omitempty"`
+	Index      string            `json:"index,omitempty"`
+	Event      interface{}       `json:"event"`
+	Fields     map[string]string `json:"fields,omitempty"`
+}
+
+// hecResponse is what HEC sends back for events and ack polls
+type hecResponse struct {
+	Text  string          `json:"text"`
+	Code  int             `json:"code"`
+	AckID *int64          `json:"ackId"`
+	Acks  map[string]bool `json:"acks"`
+}
+
+// Defaults for the HEC output
+const (
+	defaultHECAckPollMillis = 10000
+	hecAckTimeout           = 5 * time.Minute
+	hecRetries              = 3
+)
+
+// hec holds the running HEC output
+var hec struct {
+	conf    HECConf
+	client  *http.Client
+	batcher *batcher
+
+	// Acks that haven't been confirmed yet, and when they were sent
+	ackMu   sync.Mutex
+	pending map[int64]time.Time
+}
+
+// ValidateHECConf checks the HEC settings before anything is sent
+func ValidateHECConf(conf HECConf) error {
+	if !strings.HasPrefix(conf.URL, "http://") && !strings.HasPrefix(conf.URL, "https://") {
+		return errors.New("HEC URL must start with http:// or https://")
+	}
+	if conf.Token == "" {
+		return errors.New("HEC needs a Token")
+	}
+	if conf.Endpoint != "" && conf.Endpoint != "event" && conf.Endpoint != "raw" {
+		return errors.New("HEC Endpoint must be in (event, raw): " + conf.Endpoint)
+	}
+	if (conf.Endpoint == "raw" || conf.UseAck) && conf.Channel == "" {
+		return errors.New("HEC needs a Channel for the raw endpoint and for acks")
+	}
+	if conf.BatchSize < 0 || conf.BatchMillis < 0 || conf.AckPollMillis < 0 {
+		return errors.New("HEC BatchSize, BatchMillis and AckPollMillis cannot be negative")
+	}
+	return nil
+}
+
+// StartHEC sets up the HEC client, batching and ack polling
+func StartHEC(conf HECConf) error {
+	client := &http.Client{Timeout: 30 * time.Second}
+	if conf.TLS.Enabled {
+		tlsConfig, err := conf.TLS.Config()
+		if err != nil {
+			return err
+		}
+		client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+
+	hec.conf = conf
+	hec.client = client
+	hec.pending = make(map[int64]time.Time)
+	hec.batcher = newBatcher(conf.BatchSize, conf.BatchMillis, flushHEC)
+
+	if conf.UseAck {
+		go pollHECAcks()
+	}
+
+	return nil
+}
+
+// sendLogLineHEC adds the log line to the next HEC batch
+func sendLogLineHEC(stringBody []byte, params LogLineProperties) {
+	if hec.batcher == nil {
+		log.Error("HEC output used without HEC settings in the global conf, dropping line")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"line": string(stringBody),
+	}).Info("Sending log to HEC")
+
+	hec.batcher.add(stringBody, params)
+}
+
+// hecMeta works out a line's metadata, rendering any wildcards in it
+func hecMeta(params LogLineProperties) HECMeta {
+	scope := loggenmunger.TokenScope{LineID: params.LineID, SourceFile: params.SourceFile, Vars: params.Vars}
+	pick := func(line string, global string) string {
+		if line == "" {
+			line = global
+		}
+		return loggenmunger.RandomizeString(line, params.TimestampFormat, scope)
+	}
+
+	return HECMeta{
+		Host:       pick(params.HEC.Host, hec.conf.Host),
+		Source:     pick(params.HEC.Source, hec.conf.Source),
+		Sourcetype: pick(params.HEC.Sourcetype, hec.conf.Sourcetype),
+		Index:      pick(params.HEC.Index, hec.conf.Index),
+		Fields:     params.HEC.Fields,
+	}
+}
+
+// flushHEC sends a batch of lines to HEC
+func flushHEC(lines []queuedLine) {
+	if hec.conf.Endpoint == "raw" {
+		flushHECRaw(lines)
+		return
+	}
+
+	var body bytes.Buffer
+	var built []queuedLine
+	for _, line := range lines {
+		meta := hecMeta(line.params)
+		// The event time is when the line was generated, not a timestamp
+		// in its text, which can have an offset or come from a replay file
+		event := hecEvent{
+			Time:       json.Number(strconv.FormatFloat(float64(line.params.GeneratedAt.UnixNano())/1e9, 'f', 3, 64)),
+			Host:       meta.Host,
+			Source:     meta.Source,
+			Sourcetype: meta.Sourcetype,
+			Index:      meta.Index,
+			Event:      string(line.body),
+			Fields:     meta.Fields,
+		}
+		// JSON lines are sent as objects so Splunk keeps their structure
+		if bytes.HasPrefix(line.body, []byte("{")) && json.Valid(line.body) {
+			event.Event = json.RawMessage(line.body)
+		}
+
+		encoded, err := json.Marshal(event)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error_msg": err,
+				"line":      string(line.body),
+			}).Error("Couldn't build the HEC event, dropping line")
+			continue
+		}
+		body.Write(encoded)
+		built = append(built, line)
+	}
+
+	if postHEC("/services/collector/event", nil, body.Bytes(), len(built)) {
+		countSentLines(built)
+	}
+}
+
+// flushHECRaw sends a batch of lines to the raw endpoint. Metadata goes in
+// the query string there, so lines are grouped by their metadata.
+func flushHECRaw(lines []queuedLine) {
+	type rawMeta struct{ host, source, sourcetype, index string }
+
+	groups := make(map[rawMeta]*bytes.Buffer)
+	grouped := make(map[rawMeta][]queuedLine)
+	for _, line := range lines {
+		full := hecMeta(line.params)
+		meta := rawMeta{full.Host, full.Source, full.Sourcetype, full.Index}
+		if groups[meta] == nil {
+			groups[meta] = &bytes.Buffer{}
+		}
+		groups[meta].Write(line.body)
+		groups[meta].WriteByte('\n')
+		grouped[meta] = append(grouped[meta], line)
+	}
+
+	for meta, body := range groups {
+		query := url.Values{}
+		for key, value := range map[string]string{"host": meta.host, "source": meta.source, "sourcetype": meta.sourcetype, "index": meta.index} {
+			if value != "" {
+				query.Set(key, value)
+			}
+		}
+		if postHEC("/services/collector/raw", query, body.Bytes(), len(grouped[meta])) {
+			countSentLines(grouped[meta])
+		}
+	}
+}
+
+// postHEC sends a request to HEC, retrying when the server is busy, and
+// keeps track of the ack if acks are on. It says whether HEC took the batch.
+func postHEC(path string, query url.Values, body []byte, count int) bool {
+	endpoint := strings.TrimSuffix(hec.conf.URL, "/") + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+
+	for attempt := 1; attempt <= hecRetries; attempt++ {
+		response, status, err := hecRequest(endpoint, body)
+		if err == nil && status == http.StatusOK && response.Code == 0 {
+			if hec.conf.UseAck && response.AckID != nil {
+				hec.ackMu.Lock()
+				hec.pending[*response.AckID] = time.Now()
+				hec.ackMu.Unlock()
+			}
+			log.WithFields(log.Fields{
+				"events": count,
+			}).Debug("HEC batch accepted")
+			return true
+		}
+
+		// Only a busy server (503, or code 9) is worth trying again
+		if err == nil && status != http.StatusServiceUnavailable && response.Code != 9 {
+			log.WithFields(log.Fields{
+				"statusCode": status,
+				"code":       response.Code,
+				"text":       response.Text,
+				"events":     count,
+			}).Error("HEC rejected the batch")
+			return false
+		}
+
+		log.WithFields(log.Fields{
+			"error_msg":     err,
+			"statusCode":    status,
+			"attemptNumber": attempt,
+		}).Warn("HEC request failed, retrying")
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+
+	log.WithFields(log.Fields{
+		"events": count,
+	}).Error("HEC request failed and retries ran out, dropping batch")
+	return false
+}
+
+// hecRequest POSTs to HEC with the token and channel, and parses the reply
+func hecRequest(endpoint string, body []byte) (hecResponse, int, error) {
+	var response hecResponse
+
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return response, 0, err
+	}
+	req.Header.Set("Authorization", "Splunk "+hec.conf.Token)
+	if hec.conf.Channel != "" {
+		req.Header.Set("X-Splunk-Request-Channel", hec.conf.Channel)
+	}
+
+	resp, err := hec.client.Do(req)
+	if err != nil {
+		return response, 0, err
+	}
+	defer resp.Body.Close()
+
+	// Once HEC has answered, its status decides what happens to the batch. A
+	// 200 means HEC took it, so a reply that can't be read is only warned
+	// about, since sending the batch again would duplicate its events.
+	replyBody, err := ioutil.ReadAll(resp.Body)
+	if err == nil {
+		err = json.Unmarshal(replyBody, &response)
+	}
+	if err != nil && resp.StatusCode == http.StatusOK {
+		log.WithFields(log.Fields{
+			"error_msg": err,
+			"response":  string(replyBody),
+		}).Warn("Couldn't parse the HEC response to a 200, so taking the request as accepted")
+	}
+
+	return response, resp.StatusCode, nil
+}
+
+// pollHECAcks asks HEC which batches have been indexed, and warns about
+// batches that still haven't been after hecAckTimeout
+func pollHECAcks() {
+	interval := hec.conf.AckPollMillis
+	if interval == 0 {
+		interval = defaultHECAckPollMillis
+	}
+
+	for range time.Tick(time.Duration(interval) * time.Millisecond) {
+		hec.ackMu.Lock()
+		var ids []int64
+		for id, sent := range hec.pending {
+			if time.Since(sent) > hecAckTimeout {
+				log.WithFields(log.Fields{
+					"ackId": id,
+				}).Warn("HEC batch was never acknowledged as indexed")
+				delete(hec.pending, id)
+				continue
+			}
+			ids = append(ids, id)
+		}
+		hec.ackMu.Unlock()
+
+		if len(ids) == 0 {
+			continue
+		}
+
+		body, _ := json.Marshal(map[string][]int64{"acks": ids})
+		response, status, err := hecRequest(strings.TrimSuffix(hec.conf.URL, "/")+"/services/collector/ack", body)
+		if err != nil || status != http.StatusOK {
+			log.WithFields(log.Fields{
+				"error_msg":  err,
+				"statusCode": status,
+				"text":       response.Text,
+			}).Warn("Couldn't poll HEC for acks")
+			continue
+		}
+
+		hec.ackMu.Lock()
+		for id, indexed := range response.Acks {
+			if !indexed {
+				continue
+			}
+			if ackID, err := strconv.ParseInt(id, 10, 64); err == nil {
+				delete(hec.pending, ackID)
+			}
+		}
+		hec.ackMu.Unlock()
+	}
+}
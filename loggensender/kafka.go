@@ -0,0 +1,255 @@
+package loggensender
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/ftwynn/gologgen/loggenmunger"
+	"github.com/xdg-go/scram"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// KafkaConf holds the settings for the Kafka output
+type KafkaConf struct {
+	Brokers     []string      `json:"Brokers"`
+	Topic       string        `json:"Topic"`
+	Key         string        `json:"Key"`
+	Acks        string        `json:"Acks"`
+	Compression string        `json:"Compression"`
+	BatchSize   int           `json:"BatchSize"`
+	BatchMillis int           `json:"BatchMillis"`
+	Version     string        `json:"Version"`
+	ClientID    string        `json:"ClientID"`
+	SASL        KafkaSASLConf `json:"SASL"`
+	TLS         TLSConf       `json:"TLS"`
+}
+
+// KafkaSASLConf holds the SASL authentication settings for Kafka
+type KafkaSASLConf struct {
+	Mechanism string `json:"Mechanism"`
+	Username  string `json:"Username"`
+	Password  string `json:"Password"`
+}
+
+// kafka holds the running producer and the settings it was made with, and
+// tracks the goroutines reading the producer's results
+var kafka struct {
+	conf     KafkaConf
+	producer sarama.AsyncProducer
+	results  sync.WaitGroup
+}
+
+var kafkaAcks = map[string]sarama.RequiredAcks{
+	"none":   sarama.NoResponse,
+	"leader": sarama.WaitForLocal,
+	"all":    sarama.WaitForAll,
+}
+
+var kafkaCompression = map[string]sarama.CompressionCodec{
+	"none":   sarama.CompressionNone,
+	"gzip":   sarama.CompressionGZIP,
+	"snappy": sarama.CompressionSnappy,
+	"lz4":    sarama.CompressionLZ4,
+	"zstd":   sarama.CompressionZSTD,
+}
+
+// ValidateKafkaConf checks the Kafka settings before anything is sent
+func ValidateKafkaConf(conf KafkaConf) error {
+	if len(conf.Brokers) == 0 {
+		return errors.New("Kafka needs at least one broker in Brokers")
+	}
+	if conf.Topic == "" {
+		return errors.New("Kafka needs a default Topic")
+	}
+	if _, ok := kafkaAcks[conf.Acks]; conf.Acks != "" && !ok {
+		return errors.New("Kafka Acks must be in (none, leader, all): " + conf.Acks)
+	}
+	if _, ok := kafkaCompression[conf.Compression]; conf.Compression != "" && !ok {
+		return errors.New("Kafka Compression must be in (none, gzip, snappy, lz4, zstd): " + conf.Compression)
+	}
+	if conf.BatchSize < 0 || conf.BatchMillis < 0 {
+		return errors.New("Kafka BatchSize and BatchMillis cannot be negative")
+	}
+	if conf.Version != "" {
+		if _, err := sarama.ParseKafkaVersion(conf.Version); err != nil {
+			return err
+		}
+	}
+
+	switch conf.SASL.Mechanism {
+	case "":
+	case "PLAIN", "SCRAM-SHA-256", "SCRAM-SHA-512":
+		if conf.SASL.Username == "" {
+			return errors.New("Kafka SASL needs a Username")
+		}
+	default:
+		return errors.New("Kafka SASL Mechanism must be in (PLAIN, SCRAM-SHA-256, SCRAM-SHA-512): " + conf.SASL.Mechanism)
+	}
+
+	return nil
+}
+
+// StartKafkaProducer connects to the Kafka brokers. Lines are produced
+// asynchronously and batched according to the settings.
+func StartKafkaProducer(conf KafkaConf) error {
+	config, err := kafkaConfig(conf)
+	if err != nil {
+		return err
+	}
+
+	producer, err := sarama.NewAsyncProducer(conf.Brokers, config)
+	if err != nil {
+		return err
+	}
+
+	kafka.conf = conf
+	kafka.producer = producer
+
+	kafka.results.Add(2)
+	go func() {
+		defer kafka.results.Done()
+		for err := range producer.Errors() {
+			log.WithFields(log.Fields{
+				"error_msg": err.Err,
+				"topic":     err.Msg.Topic,
+			}).Error("Failed to produce log line to Kafka")
+		}
+	}()
+	go func() {
+		defer kafka.results.Done()
+		for message := range producer.Successes() {
+			countSent(message.Metadata.(LogLineProperties))
+		}
+	}()
+
+	return nil
+}
+
+// StopKafkaProducer sends the lines the producer is still holding, and waits
+// for the brokers to answer for them
+func StopKafkaProducer() {
+	if kafka.producer == nil {
+		return
+	}
+	kafka.producer.AsyncClose()
+	kafka.results.Wait()
+	kafka.producer = nil
+}
+
+// kafkaConfig turns the Kafka settings into the producer's config
+func kafkaConfig(conf KafkaConf) (*sarama.Config, error) {
+	config := sarama.NewConfig()
+	config.Producer.Return.Errors = true
+	config.Producer.Return.Successes = true
+
+	config.Version = sarama.V1_0_0_0
+	if conf.Compression == "zstd" {
+		config.Version = sarama.V2_1_0_0
+	}
+	if conf.Version != "" {
+		config.Version, _ = sarama.ParseKafkaVersion(conf.Version)
+	}
+	if conf.ClientID != "" {
+		config.ClientID = conf.ClientID
+	}
+	if conf.Acks != "" {
+		config.Producer.RequiredAcks = kafkaAcks[conf.Acks]
+	}
+	if conf.Compression != "" {
+		config.Producer.Compression = kafkaCompression[conf.Compression]
+	}
+	config.Producer.Flush.Messages = conf.BatchSize
+	config.Producer.Flush.Frequency = time.Duration(conf.BatchMillis) * time.Millisecond
+
+	if conf.SASL.Mechanism != "" {
+		config.Net.SASL.Enable = true
+		config.Net.SASL.User = conf.SASL.Username
+		config.Net.SASL.Password = conf.SASL.Password
+		config.Net.SASL.Mechanism = sarama.SASLMechanism(conf.SASL.Mechanism)
+		switch conf.SASL.Mechanism {
+		case "SCRAM-SHA-256":
+			config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &scramClient{hash: scram.SHA256} }
+		case "SCRAM-SHA-512":
+			config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &scramClient{hash: scram.SHA512} }
+		}
+	}
+
+	if conf.TLS.Enabled {
+		tlsConfig, err := conf.TLS.Config()
+		if err != nil {
+			return nil, err
+		}
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
+
+	return config, nil
+}
+
+// sendLogLineKafka hands the log line to the Kafka producer. The topic and
+// key can use tokens, which see the same variables as the line.
+func sendLogLineKafka(stringBody []byte, params LogLineProperties) {
+	if kafka.producer == nil {
+		log.Error("Kafka output used without Kafka settings in the global conf, dropping line")
+		return
+	}
+
+	message := kafkaMessage(stringBody, params)
+
+	log.WithFields(log.Fields{
+		"line":  string(stringBody),
+		"topic": message.Topic,
+	}).Info("Sending log to Kafka")
+
+	kafka.producer.Input() <- message
+}
+
+// kafkaMessage builds the message for a line, rendering the wildcards in its
+// topic and key. Lines without a key are spread across the partitions.
+func kafkaMessage(stringBody []byte, params LogLineProperties) *sarama.ProducerMessage {
+	scope := loggenmunger.TokenScope{LineID: params.LineID, SourceFile: params.SourceFile, Vars: params.Vars}
+
+	topic := params.KafkaTopic
+	if topic == "" {
+		topic = kafka.conf.Topic
+	}
+	topic = loggenmunger.RandomizeString(topic, params.TimestampFormat, scope)
+
+	key := params.KafkaKey
+	if key == "" {
+		key = kafka.conf.Key
+	}
+
+	message := &sarama.ProducerMessage{Topic: strings.TrimSpace(topic), Value: sarama.ByteEncoder(stringBody), Metadata: params}
+	if key != "" {
+		message.Key = sarama.StringEncoder(loggenmunger.RandomizeString(key, params.TimestampFormat, scope))
+	}
+	return message
+}
+
+// scramClient adapts the xdg-go SCRAM implementation to sarama
+type scramClient struct {
+	hash         scram.HashGeneratorFcn
+	conversation *scram.ClientConversation
+}
+
+func (c *scramClient) Begin(userName, password, authzID string) error {
+	client, err := c.hash.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	c.conversation = client.NewConversation()
+	return nil
+}
+
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.conversation.Step(challenge)
+}
+
+func (c *scramClient) Done() bool {
+	return c.conversation.Done()
+}
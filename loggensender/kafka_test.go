@@ -0,0 +1,133 @@
+package loggensender
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestKafkaMessage(t *testing.T) {
+	defer func() { kafka.conf = KafkaConf{} }()
+
+	vars := map[string]string{"env": "prod", "session": "abc123"}
+	cases := []struct {
+		conf  KafkaConf
+		topic string
+		key   string
+		want  string
+		wKey  string
+	}{
+		{KafkaConf{Topic: "logs"}, "", "", "logs", ""},
+		{KafkaConf{Topic: " logs "}, "", "", "logs", ""},
+		{KafkaConf{Topic: "logs"}, "app-$[var||env]", "", "app-prod", ""},
+		{KafkaConf{Topic: "logs-$[var||env]"}, "", "", "logs-prod", ""},
+		{KafkaConf{Topic: "logs", Key: "$[var||session]"}, "", "", "logs", "abc123"},
+		{KafkaConf{Topic: "logs", Key: "$[var||session]"}, "", "host-1", "logs", "host-1"},
+	}
+
+	for _, c := range cases {
+		kafka.conf = c.conf
+		params := LogLineProperties{KafkaTopic: c.topic, KafkaKey: c.key, Vars: vars, TargetRate: true}
+		message := kafkaMessage([]byte("line"), params)
+
+		var key string
+		if message.Key != nil {
+			encoded, _ := message.Key.Encode()
+			key = string(encoded)
+		}
+		value, _ := message.Value.Encode()
+		if message.Topic != c.want || key != c.wKey || string(value) != "line" {
+			t.Errorf("Failed case: {%q,%q,line} >> {%q,%q,%s}", c.want, c.wKey, message.Topic, key, value)
+		}
+		if sent, ok := message.Metadata.(LogLineProperties); !ok || !sent.TargetRate {
+			t.Errorf("Failed case: %q didn't carry its properties to count it when it's sent", c.want)
+		}
+	}
+}
+
+func TestKafkaConfig(t *testing.T) {
+	cases := []struct {
+		conf        KafkaConf
+		acks        sarama.RequiredAcks
+		compression sarama.CompressionCodec
+		version     sarama.KafkaVersion
+	}{
+		{KafkaConf{}, sarama.WaitForLocal, sarama.CompressionNone, sarama.V1_0_0_0},
+		{KafkaConf{Acks: "none", Compression: "gzip"}, sarama.NoResponse, sarama.CompressionGZIP, sarama.V1_0_0_0},
+		{KafkaConf{Acks: "all", Compression: "zstd"}, sarama.WaitForAll, sarama.CompressionZSTD, sarama.V2_1_0_0},
+		{KafkaConf{Compression: "lz4", Version: "2.8.0"}, sarama.WaitForLocal, sarama.CompressionLZ4, sarama.V2_8_0_0},
+	}
+
+	for _, c := range cases {
+		config, err := kafkaConfig(c.conf)
+		if err != nil {
+			t.Errorf("Failed case: %+v >> %v", c.conf, err)
+			continue
+		}
+		if config.Producer.RequiredAcks != c.acks || config.Producer.Compression != c.compression || config.Version != c.version {
+			t.Errorf("Failed case: {%v,%v,%v} >> {%v,%v,%v}", c.acks, c.compression, c.version, config.Producer.RequiredAcks, config.Producer.Compression, config.Version)
+		}
+	}
+
+	config, _ := kafkaConfig(KafkaConf{BatchSize: 500, BatchMillis: 250})
+	if config.Producer.Flush.Messages != 500 || config.Producer.Flush.Frequency != 250*time.Millisecond {
+		t.Errorf("Failed case: {500,250ms} >> {%d,%v}", config.Producer.Flush.Messages, config.Producer.Flush.Frequency)
+	}
+	if !config.Producer.Return.Successes || !config.Producer.Return.Errors {
+		t.Errorf("Failed case: the producer doesn't return its results")
+	}
+}
+
+func TestKafkaPartitioning(t *testing.T) {
+	defer func() { kafka.conf = KafkaConf{} }()
+	kafka.conf = KafkaConf{Topic: "logs", Key: "$[var||session]"}
+
+	config, _ := kafkaConfig(kafka.conf)
+	partitioner := config.Producer.Partitioner("logs")
+	const partitions = 12
+
+	partition := func(params LogLineProperties) int32 {
+		p, err := partitioner.Partition(kafkaMessage([]byte("line"), params), partitions)
+		if err != nil || p < 0 || p >= partitions {
+			t.Fatalf("Failed case: partition in [0,%d) >> {%d,%v}", partitions, p, err)
+		}
+		return p
+	}
+
+	// Lines with the same key always go to the same partition, and lines
+	// with different keys are spread across them
+	cases := []struct {
+		session string
+	}{
+		{"alice"},
+		{"bob"},
+		{"carol"},
+		{"dave"},
+		{"erin"},
+	}
+	used := make(map[int32]bool)
+	for _, c := range cases {
+		params := LogLineProperties{Vars: map[string]string{"session": c.session}}
+		first := partition(params)
+		for i := 0; i < 10; i++ {
+			if got := partition(params); got != first {
+				t.Errorf("Failed case: %s: partition %d >> %d", c.session, first, got)
+			}
+		}
+		used[first] = true
+	}
+	if len(used) < 2 {
+		t.Errorf("Failed case: keyed lines all went to one partition")
+	}
+
+	// Without a key, lines are spread across the partitions
+	kafka.conf.Key = ""
+	used = make(map[int32]bool)
+	for i := 0; i < 100; i++ {
+		used[partition(LogLineProperties{})] = true
+	}
+	if len(used) < 2 {
+		t.Errorf("Failed case: lines without a key all went to one partition")
+	}
+}
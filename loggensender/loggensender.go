@@ -2,10 +2,10 @@ package loggensender
 
 import (
 	"bytes"
-	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
-	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/ftwynn/gologgen/loggenmunger"
@@ -18,17 +18,40 @@ type LogLineProperties struct {
 	OutputType           string
 	SyslogType           string
 	SyslogLoc            string
-	HTTPLoc              string              `json:"HTTPLoc"`
-	Text                 string              `json:"Text"`
-	IntervalSecs         int                 `json:"IntervalSecs"`
-	IntervalStdDev       float64             `json:"IntervalStdDev"`
-	IntervalMillis       int                 `json:"IntervalMillis"`
-	IntervalStdDevMillis int                 `json:"IntervalStdDevMillis"`
-	TimestampFormat      string              `json:"TimestampFormat"`
-	Headers              []LogLineHTTPHeader `json:"Headers"`
-	StartTime            string              `json:"StartTime"`
+	HTTPLoc              string                 `json:"HTTPLoc"`
+	Text                 string                 `json:"Text"`
+	IntervalSecs         int                    `json:"IntervalSecs"`
+	IntervalStdDev       float64                `json:"IntervalStdDev"`
+	IntervalMillis       int                    `json:"IntervalMillis"`
+	IntervalStdDevMillis int                    `json:"IntervalStdDevMillis"`
+	ArrivalModel         string                 `json:"ArrivalModel"`
+	BurstOnSecs          float64                `json:"BurstOnSecs"`
+	BurstOffSecs         float64                `json:"BurstOffSecs"`
+	Weight               float64                `json:"Weight"`
+	KafkaTopic           string                 `json:"KafkaTopic"`
+	KafkaKey             string                 `json:"KafkaKey"`
+	HEC                  HECMeta                `json:"HEC"`
+	ESIndex              string                 `json:"ESIndex"`
+	LokiLabels           map[string]string      `json:"LokiLabels"`
+	OTLP                 OTLPLine               `json:"OTLP"`
+	GELF                 GELFLine               `json:"GELF"`
+	FluentTag            string                 `json:"FluentTag"`
+	FilePath             string                 `json:"FilePath"`
+	GeneratedAt          time.Time              `json:"-"`
+	ScheduledAt          time.Time              `json:"-"`
+	TimestampFormat      string                 `json:"TimestampFormat"`
+	Headers              []LogLineHTTPHeader    `json:"Headers"`
+	StartTime            string                 `json:"StartTime"`
+	RateProfile          string                 `json:"RateProfile"`
+	Engine               string                 `json:"Engine"`
+	Fields               loggenmunger.FieldList `json:"Fields"`
+	LineID               string
+	SourceFile           string
+	Vars                 map[string]string `json:"-"`
+	Scenario             string            `json:"-"`
+	Replay               bool              `json:"-"`
+	TargetRate           bool              `json:"-"`
 	HTTPClient           *http.Client
-	FileHandler          *os.File
 }
 
 // LogLineHTTPHeader holds the key and vlue for each header
@@ -41,27 +64,52 @@ type LogLineHTTPHeader struct {
 func RunLogLine(runQueue chan LogLineProperties) {
 	for params := range runQueue {
 		// Randomize the text if need be
-		var stringBody = []byte(loggenmunger.RandomizeString(params.Text, params.TimestampFormat))
-
-		switch params.OutputType {
-		case "http":
-			go sendLogLineHTTP(params.HTTPClient, stringBody, params)
-		case "syslog":
-			go sendLogLineSyslog(stringBody, params)
-		case "file":
-			go sendLogLineFile(stringBody, params)
+		params.GeneratedAt = time.Now()
+		if params.ScheduledAt.IsZero() {
+			params.ScheduledAt = params.GeneratedAt
 		}
+		scope := loggenmunger.TokenScope{LineID: params.LineID, SourceFile: params.SourceFile, Vars: params.Vars}
+		var stringBody []byte
+		switch params.Engine {
+		case "template":
+			stringBody = []byte(loggenmunger.RenderTemplate(params.Text, params.TimestampFormat, scope))
+		case "json":
+			stringBody = []byte(loggenmunger.RenderJSONEvent(params.Fields, params.TimestampFormat, scope))
+		default:
+			stringBody = []byte(loggenmunger.RandomizeString(params.Text, params.TimestampFormat, scope))
+		}
+
+		// Hand the line to its output's queue, which does the sending
+		queue, ok := outputQueues[params.OutputType]
+		if !ok {
+			log.WithFields(log.Fields{
+				"output":        params.OutputType,
+				"line":          string(stringBody),
+				"total_dropped": atomic.AddInt64(&unqueuedDropped, 1),
+			}).Error("No output queue for the line's OutputType, dropping line")
+			continue
+		}
+		queue.enqueue(queuedLine{body: stringBody, params: params})
 	}
 }
 
 // sendLogLineHTTP sends the log line to the http endpoint, retrying if need be
-func sendLogLineHTTP(client *http.Client, stringBody []byte, params LogLineProperties) {
+func sendLogLineHTTP(stringBody []byte, params LogLineProperties) {
+	client := params.HTTPClient
+
 	// Post to HTTP
 	log.WithFields(log.Fields{
 		"line": string(stringBody),
 	}).Info("Sending log over HTTP")
 
 	req, err := http.NewRequest("POST", params.HTTPLoc, bytes.NewBuffer(stringBody))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error_msg": err,
+			"line":      string(stringBody),
+		}).Error("Couldn't create the http request")
+		return
+	}
 	for _, header := range params.Headers {
 		req.Header.Add(header.Header, header.Value)
 	}
@@ -70,7 +118,6 @@ func sendLogLineHTTP(client *http.Client, stringBody []byte, params LogLinePrope
 	}).Debug("Request object to send to Sumo")
 
 	resp, err := client.Do(req)
-	defer resp.Body.Close()
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error_msg": err,
@@ -78,6 +125,11 @@ func sendLogLineHTTP(client *http.Client, stringBody []byte, params LogLinePrope
 		}).Error("Something went wrong with the http client")
 		return
 	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 200 {
+		countSent(params)
+	}
 
 	// For non 200 StatusCode, retry 5 times and then give up
 	if resp.StatusCode != 200 {
@@ -86,10 +138,14 @@ func sendLogLineHTTP(client *http.Client, stringBody []byte, params LogLinePrope
 			log.WithFields(log.Fields{
 				"attemptNumber": i + 1,
 			}).Debug("Retrying HTTP Post")
+			req.Body = ioutil.NopCloser(bytes.NewReader(stringBody))
 			resp2, err := client.Do(req)
-			defer resp.Body.Close()
-			if resp2.StatusCode == 200 && err == nil {
-				break
+			if err == nil {
+				resp2.Body.Close()
+				if resp2.StatusCode == 200 {
+					countSent(params)
+					break
+				}
 			}
 			if i == 4 {
 				log.WithFields(log.Fields{
@@ -105,7 +161,7 @@ func sendLogLineHTTP(client *http.Client, stringBody []byte, params LogLinePrope
 	}).Debug("Response from Sumo")
 }
 
-//sendLogLineSyslog sends the log on tcp/udp, WITHOUT retrying
+// sendLogLineSyslog sends the log on tcp/udp, WITHOUT retrying
 func sendLogLineSyslog(stringBody []byte, params LogLineProperties) {
 	log.WithFields(log.Fields{
 		"line":     string(stringBody),
@@ -119,23 +175,35 @@ func sendLogLineSyslog(stringBody []byte, params LogLineProperties) {
 			"type":           params.SyslogType,
 			"syslogLocation": params.SyslogLoc,
 		}).Error("Failed to create syslog connection, abandoning")
+		return
 	}
 	defer conn.Close()
 
-	fmt.Fprintf(conn, string(stringBody))
+	if _, err := conn.Write(stringBody); err == nil {
+		countSent(params)
+	}
 }
 
-//sendLogLineFile writes log lines to a file
+// sendLogLineFile writes log lines to the line's file
 func sendLogLineFile(stringBody []byte, params LogLineProperties) {
+	path := outputFilePath(params)
+	if path == "" {
+		log.WithFields(log.Fields{
+			"line": string(stringBody),
+		}).Error("File output used without a FilePath or FileOutputPath, dropping line")
+		return
+	}
+
 	log.WithFields(log.Fields{
 		"line": string(stringBody),
+		"path": path,
 	}).Info("Writing log to file")
 
-	_, err := params.FileHandler.Write(append(stringBody, []byte("\n")...))
-	if err != nil {
-		log.WithFields(log.Fields{
-			"error_msg": err,
-		}).Fatal("Error writing to file")
+	if files.lines == nil {
+		log.Error("File output used before it was started, dropping line")
+		return
 	}
 
+	// The file output's writer does the writing, in the order lines were scheduled
+	files.lines <- fileLine{path: path, body: append(stringBody, []byte("\n")...), scheduledAt: params.ScheduledAt, targetRate: params.TargetRate}
 }
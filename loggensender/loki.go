@@ -0,0 +1,401 @@
+package loggensender
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ftwynn/gologgen/loggenmunger"
+	"github.com/golang/snappy"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// LokiConf holds the settings for the Grafana Loki output
+type LokiConf struct {
+	URL         string            `json:"URL"`
+	Format      string            `json:"Format"`
+	TenantID    string            `json:"TenantID"`
+	Username    string            `json:"Username"`
+	Password    string            `json:"Password"`
+	Labels      map[string]string `json:"Labels"`
+	LabelFields []string          `json:"LabelFields"`
+	BatchSize   int               `json:"BatchSize"`
+	BatchMillis int               `json:"BatchMillis"`
+	TLS         TLSConf           `json:"TLS"`
+}
+
+// lokiEntry is one line in a stream
+type lokiEntry struct {
+	time time.Time
+	line string
+}
+
+// lokiStream is the lines of a batch that share a label set
+type lokiStream struct {
+	labels  map[string]string
+	key     string
+	entries []lokiEntry
+}
+
+const (
+	defaultLokiFormat = "protobuf"
+	lokiPushPath      = "/loki/api/v1/push"
+	lokiRetries       = 3
+)
+
+// lokiStreamIdle is how long a stream can go without an entry before its
+// newest time is forgotten, so streams whose labels change, like ones with
+// a timestamp or a random ID in them, don't pile up
+const lokiStreamIdle = time.Hour
+
+// lokiLabelName is what Loki allows in a label name
+var lokiLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// loki holds the running Loki output
+var loki struct {
+	conf    LokiConf
+	client  *http.Client
+	batcher *batcher
+
+	// The newest timestamp sent on each stream, so later entries are never
+	// older, and when idle streams were last pruned from it. Only the
+	// batcher's goroutine uses them.
+	lastSent   map[string]time.Time
+	lastPruned time.Time
+}
+
+// ValidateLokiConf checks the Loki settings before anything is sent
+func ValidateLokiConf(conf LokiConf) error {
+	if !strings.HasPrefix(conf.URL, "http://") && !strings.HasPrefix(conf.URL, "https://") {
+		return errors.New("Loki URL must start with http:// or https://")
+	}
+	if conf.Format != "" && conf.Format != "json" && conf.Format != "protobuf" {
+		return errors.New("Loki Format must be in (json, protobuf): " + conf.Format)
+	}
+	if len(conf.Labels) == 0 && len(conf.LabelFields) == 0 {
+		return errors.New("Loki needs at least one label in Labels or LabelFields")
+	}
+	if err := ValidateLokiLabels(conf.Labels); err != nil {
+		return err
+	}
+	for _, name := range conf.LabelFields {
+		if !lokiLabelName.MatchString(name) {
+			return errors.New("Loki LabelFields must be valid label names: " + name)
+		}
+	}
+	if conf.BatchSize < 0 || conf.BatchMillis < 0 {
+		return errors.New("Loki BatchSize and BatchMillis cannot be negative")
+	}
+	return nil
+}
+
+// ValidateLokiLabels checks that label names are ones Loki will take
+func ValidateLokiLabels(labels map[string]string) error {
+	for name := range labels {
+		if !lokiLabelName.MatchString(name) {
+			return errors.New("Loki label names must be letters, digits and underscores, not starting with a digit: " + name)
+		}
+	}
+	return nil
+}
+
+// StartLoki sets up the Loki client and batching
+func StartLoki(conf LokiConf) error {
+	client := &http.Client{Timeout: 30 * time.Second}
+	if conf.TLS.Enabled {
+		tlsConfig, err := conf.TLS.Config()
+		if err != nil {
+			return err
+		}
+		client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+
+	if conf.Format == "" {
+		conf.Format = defaultLokiFormat
+	}
+
+	loki.conf = conf
+	loki.client = client
+	loki.lastSent = make(map[string]time.Time)
+	loki.batcher = newBatcher(conf.BatchSize, conf.BatchMillis, flushLoki)
+
+	return nil
+}
+
+// sendLogLineLoki adds the log line to the next Loki push
+func sendLogLineLoki(stringBody []byte, params LogLineProperties) {
+	if loki.batcher == nil {
+		log.Error("Loki output used without Loki settings in the global conf, dropping line")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"line": string(stringBody),
+	}).Info("Sending log to Loki")
+
+	loki.batcher.add(stringBody, params)
+}
+
+// lokiLabels works out a line's labels: the global ones, then the line's
+// own, then any LabelFields found in a JSON line. Values can use wildcards.
+func lokiLabels(stringBody []byte, params LogLineProperties) map[string]string {
+	scope := loggenmunger.TokenScope{LineID: params.LineID, SourceFile: params.SourceFile, Vars: params.Vars}
+
+	labels := make(map[string]string)
+	for _, set := range []map[string]string{loki.conf.Labels, params.LokiLabels} {
+		for name, value := range set {
+			labels[name] = loggenmunger.RandomizeString(value, params.TimestampFormat, scope)
+		}
+	}
+
+	if len(loki.conf.LabelFields) > 0 && bytes.HasPrefix(stringBody, []byte("{")) {
+		var fields map[string]interface{}
+		if json.Unmarshal(stringBody, &fields) == nil {
+			for _, name := range loki.conf.LabelFields {
+				if value, ok := fields[name]; ok && value != nil {
+					labels[name] = fmt.Sprint(value)
+				}
+			}
+		}
+	}
+
+	// Loki drops labels with empty values, so leave them out of the key too
+	for name, value := range labels {
+		if value == "" {
+			delete(labels, name)
+		}
+	}
+
+	return labels
+}
+
+// lokiLabelString writes labels the way LogQL does, like {app="web", env="prod"}
+func lokiLabelString(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + strconv.Quote(labels[name])
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+// flushLoki groups a batch into streams and pushes it. Loki wants the
+// entries of a stream in time order, so they're sorted, and an entry older
+// than one already sent on its stream is moved up to that time.
+func flushLoki(lines []queuedLine) {
+	streams := make(map[string]*lokiStream)
+	var order []*lokiStream
+	var labelled []queuedLine
+	for _, line := range lines {
+		labels := lokiLabels(line.body, line.params)
+		if len(labels) == 0 {
+			log.WithFields(log.Fields{
+				"line": string(line.body),
+			}).Error("Loki line has no labels, dropping line")
+			continue
+		}
+
+		key := lokiLabelString(labels)
+		stream, ok := streams[key]
+		if !ok {
+			stream = &lokiStream{labels: labels, key: key}
+			streams[key] = stream
+			order = append(order, stream)
+		}
+		stream.entries = append(stream.entries, lokiEntry{time: line.params.GeneratedAt, line: string(line.body)})
+		labelled = append(labelled, line)
+	}
+
+	count := 0
+	for _, stream := range order {
+		sort.SliceStable(stream.entries, func(i, j int) bool { return stream.entries[i].time.Before(stream.entries[j].time) })
+		last := loki.lastSent[stream.key]
+		for i := range stream.entries {
+			if stream.entries[i].time.Before(last) {
+				stream.entries[i].time = last
+			}
+			last = stream.entries[i].time
+		}
+		loki.lastSent[stream.key] = last
+		count += len(stream.entries)
+	}
+	if now := time.Now(); now.Sub(loki.lastPruned) >= lokiStreamIdle {
+		pruneLokiStreams(now)
+	}
+	if count == 0 {
+		return
+	}
+
+	var body []byte
+	contentType := "application/json"
+	if loki.conf.Format == "protobuf" {
+		body = snappy.Encode(nil, lokiProtobuf(order))
+		contentType = "application/x-protobuf"
+	} else {
+		body = lokiJSON(order)
+	}
+
+	if pushLoki(body, contentType, count) {
+		countSentLines(labelled)
+	}
+}
+
+// pruneLokiStreams forgets the streams that haven't had an entry for
+// lokiStreamIdle. A line generated that long ago isn't going to turn up in a
+// batch, so nothing can be sent out of order on them.
+func pruneLokiStreams(now time.Time) {
+	for key, last := range loki.lastSent {
+		if now.Sub(last) >= lokiStreamIdle {
+			delete(loki.lastSent, key)
+		}
+	}
+	loki.lastPruned = now
+}
+
+// lokiJSON builds the JSON form of a push request
+func lokiJSON(streams []*lokiStream) []byte {
+	type jsonStream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+
+	request := struct {
+		Streams []jsonStream `json:"streams"`
+	}{}
+	for _, stream := range streams {
+		values := make([][2]string, len(stream.entries))
+		for i, entry := range stream.entries {
+			values[i] = [2]string{strconv.FormatInt(entry.time.UnixNano(), 10), entry.line}
+		}
+		request.Streams = append(request.Streams, jsonStream{Stream: stream.labels, Values: values})
+	}
+
+	body, _ := json.Marshal(request)
+	return body
+}
+
+// lokiProtobuf builds the protobuf form of a push request. The messages are
+// small enough to write out by hand:
+//
+//	PushRequest { repeated Stream streams = 1; }
+//	Stream      { string labels = 1; repeated Entry entries = 2; }
+//	Entry       { Timestamp timestamp = 1; string line = 2; }
+//	Timestamp   { int64 seconds = 1; int32 nanos = 2; }
+func lokiProtobuf(streams []*lokiStream) []byte {
+	var request []byte
+	for _, stream := range streams {
+		var streamMessage []byte
+		streamMessage = protoBytes(streamMessage, 1, []byte(stream.key))
+		for _, entry := range stream.entries {
+			var timestamp []byte
+			timestamp = protoVarint(timestamp, 1, uint64(entry.time.Unix()))
+			timestamp = protoVarint(timestamp, 2, uint64(entry.time.Nanosecond()))
+
+			var entryMessage []byte
+			entryMessage = protoBytes(entryMessage, 1, timestamp)
+			entryMessage = protoBytes(entryMessage, 2, []byte(entry.line))
+
+			streamMessage = protoBytes(streamMessage, 2, entryMessage)
+		}
+		request = protoBytes(request, 1, streamMessage)
+	}
+	return request
+}
+
+// protoVarint appends a varint field, leaving it out if it's zero like proto3 does
+func protoVarint(message []byte, field int, value uint64) []byte {
+	if value == 0 {
+		return message
+	}
+	message = appendUvarint(message, uint64(field)<<3)
+	return appendUvarint(message, value)
+}
+
+// protoBytes appends a length-delimited field
+func protoBytes(message []byte, field int, value []byte) []byte {
+	message = appendUvarint(message, uint64(field)<<3|2)
+	message = appendUvarint(message, uint64(len(value)))
+	return append(message, value...)
+}
+
+func appendUvarint(message []byte, value uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(message, buf[:binary.PutUvarint(buf[:], value)]...)
+}
+
+// pushLoki sends a push request, retrying when Loki is rate limiting or
+// having trouble. It says whether Loki took the push.
+func pushLoki(body []byte, contentType string, count int) bool {
+	endpoint := strings.TrimSuffix(loki.conf.URL, "/") + lokiPushPath
+
+	for attempt := 1; attempt <= lokiRetries; attempt++ {
+		status, reply, err := lokiRequest(endpoint, body, contentType)
+		if err == nil && status/100 == 2 {
+			log.WithFields(log.Fields{
+				"lines": count,
+			}).Debug("Loki push accepted")
+			return true
+		}
+
+		// Only rate limiting and server errors are worth trying again
+		if err == nil && status != http.StatusTooManyRequests && status < 500 {
+			log.WithFields(log.Fields{
+				"statusCode": status,
+				"response":   reply,
+				"lines":      count,
+			}).Error("Loki rejected the push")
+			return false
+		}
+
+		log.WithFields(log.Fields{
+			"error_msg":     err,
+			"statusCode":    status,
+			"attemptNumber": attempt,
+		}).Warn("Loki push failed, retrying")
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+
+	log.WithFields(log.Fields{
+		"lines": count,
+	}).Error("Loki push failed and retries ran out, dropping batch")
+	return false
+}
+
+// lokiRequest POSTs to Loki with the tenant and auth, and returns the reply
+func lokiRequest(endpoint string, body []byte, contentType string) (int, string, error) {
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if loki.conf.TenantID != "" {
+		req.Header.Set("X-Scope-OrgID", loki.conf.TenantID)
+	}
+	if loki.conf.Username != "" {
+		req.SetBasicAuth(loki.conf.Username, loki.conf.Password)
+	}
+
+	resp, err := loki.client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	reply, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(reply), err
+}
@@ -0,0 +1,87 @@
+package loggensender
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestLokiProtobuf(t *testing.T) {
+	key := `{job="a"}`
+	entry := func(sec, nsec int64, line string) lokiEntry {
+		return lokiEntry{time: time.Unix(sec, nsec), line: line}
+	}
+
+	cases := []struct {
+		name    string
+		streams []*lokiStream
+		want    []byte
+	}{
+		{"no streams", nil, nil},
+		{
+			"seconds and nanos",
+			[]*lokiStream{{key: key, entries: []lokiEntry{entry(1, 5, "x")}}},
+			append(append([]byte{0x0a, 0x16, 0x0a, 0x09}, key...),
+				0x12, 0x09, 0x0a, 0x04, 0x08, 0x01, 0x10, 0x05, 0x12, 0x01, 'x'),
+		},
+		{
+			// Zero nanos are left out of the timestamp like proto3 does
+			"zero nanos",
+			[]*lokiStream{{key: key, entries: []lokiEntry{entry(2, 0, "y")}}},
+			append(append([]byte{0x0a, 0x14, 0x0a, 0x09}, key...),
+				0x12, 0x07, 0x0a, 0x02, 0x08, 0x02, 0x12, 0x01, 'y'),
+		},
+		{
+			// A large second count takes a multi-byte varint
+			"multi-byte seconds",
+			[]*lokiStream{{key: key, entries: []lokiEntry{entry(1451606400, 0, "z")}}},
+			append(append([]byte{0x0a, 0x18, 0x0a, 0x09}, key...),
+				0x12, 0x0b, 0x0a, 0x06, 0x08, 0x80, 0x83, 0x97, 0xb4, 0x05, 0x12, 0x01, 'z'),
+		},
+		{
+			"two entries",
+			[]*lokiStream{{key: key, entries: []lokiEntry{entry(1, 5, "x"), entry(2, 0, "y")}}},
+			append(append([]byte{0x0a, 0x1f, 0x0a, 0x09}, key...),
+				0x12, 0x09, 0x0a, 0x04, 0x08, 0x01, 0x10, 0x05, 0x12, 0x01, 'x',
+				0x12, 0x07, 0x0a, 0x02, 0x08, 0x02, 0x12, 0x01, 'y'),
+		},
+	}
+
+	for _, c := range cases {
+		got := lokiProtobuf(c.streams)
+		if !bytes.Equal(got, c.want) {
+			t.Errorf("Failed case: %s: % x >> % x", c.name, c.want, got)
+		}
+	}
+}
+
+func TestLokiPruneStreams(t *testing.T) {
+	defer func() { loki.lastSent = nil }()
+
+	now := time.Now()
+	loki.lastSent = map[string]time.Time{
+		`{job="recent"}`:   now.Add(-time.Minute),
+		`{job="almost"}`:   now.Add(-lokiStreamIdle + time.Second),
+		`{job="idle"}`:     now.Add(-lokiStreamIdle),
+		`{id="long-gone"}`: now.Add(-24 * time.Hour),
+	}
+	pruneLokiStreams(now)
+
+	cases := []struct {
+		key  string
+		kept bool
+	}{
+		{`{job="recent"}`, true},
+		{`{job="almost"}`, true},
+		{`{job="idle"}`, false},
+		{`{id="long-gone"}`, false},
+	}
+	for _, c := range cases {
+		if _, kept := loki.lastSent[c.key]; kept != c.kept {
+			t.Errorf("Failed case: %s kept: %v >> %v", c.key, c.kept, kept)
+		}
+	}
+	if !loki.lastPruned.Equal(now) {
+		t.Errorf("Failed case: last pruned %v >> %v", now, loki.lastPruned)
+	}
+}
@@ -0,0 +1,390 @@
+package loggensender
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ftwynn/gologgen/loggenmunger"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// OTLPConf holds the settings for the OpenTelemetry logs output
+type OTLPConf struct {
+	Endpoint           string            `json:"Endpoint"`
+	Protocol           string            `json:"Protocol"`
+	Headers            map[string]string `json:"Headers"`
+	ServiceName        string            `json:"ServiceName"`
+	HostName           string            `json:"HostName"`
+	ResourceAttributes map[string]string `json:"ResourceAttributes"`
+	Severity           string            `json:"Severity"`
+	BatchSize          int               `json:"BatchSize"`
+	BatchMillis        int               `json:"BatchMillis"`
+	TLS                TLSConf           `json:"TLS"`
+}
+
+// OTLPLine is the per-line OTLP settings. Both can use wildcards.
+type OTLPLine struct {
+	Severity   string            `json:"Severity"`
+	Attributes map[string]string `json:"Attributes"`
+}
+
+// Defaults for the OTLP output
+const (
+	defaultOTLPProtocol    = "http/protobuf"
+	defaultOTLPServiceName = "gologgen"
+	defaultOTLPSeverity    = "INFO"
+	otlpLogsPath           = "/v1/logs"
+	otlpRetries            = 3
+	otlpTimeout            = 30 * time.Second
+)
+
+// otlpSeverities maps severity text to the OTLP severity numbers
+var otlpSeverities = map[string]logspb.SeverityNumber{
+	"TRACE": logspb.SeverityNumber_SEVERITY_NUMBER_TRACE,
+	"DEBUG": logspb.SeverityNumber_SEVERITY_NUMBER_DEBUG,
+	"INFO":  logspb.SeverityNumber_SEVERITY_NUMBER_INFO,
+	"WARN":  logspb.SeverityNumber_SEVERITY_NUMBER_WARN,
+	"ERROR": logspb.SeverityNumber_SEVERITY_NUMBER_ERROR,
+	"FATAL": logspb.SeverityNumber_SEVERITY_NUMBER_FATAL,
+}
+
+// otlp holds the running OTLP output
+var otlp struct {
+	conf     OTLPConf
+	resource *resourcepb.Resource
+	client   *http.Client
+	grpc     collogspb.LogsServiceClient
+	batcher  *batcher
+}
+
+// ValidateOTLPConf checks the OTLP settings before anything is sent
+func ValidateOTLPConf(conf OTLPConf) error {
+	switch conf.Protocol {
+	case "", "http/protobuf", "http/json":
+		if !strings.HasPrefix(conf.Endpoint, "http://") && !strings.HasPrefix(conf.Endpoint, "https://") {
+			return errors.New("OTLP Endpoint must start with http:// or https:// for the HTTP protocols")
+		}
+	case "grpc":
+		if conf.Endpoint == "" || strings.Contains(conf.Endpoint, "://") {
+			return errors.New("OTLP Endpoint must be in the form host:port for grpc")
+		}
+	default:
+		return errors.New("OTLP Protocol must be in (http/protobuf, http/json, grpc): " + conf.Protocol)
+	}
+	if err := validateOTLPSeverity(conf.Severity); err != nil {
+		return err
+	}
+	if conf.BatchSize < 0 || conf.BatchMillis < 0 {
+		return errors.New("OTLP BatchSize and BatchMillis cannot be negative")
+	}
+	return nil
+}
+
+// ValidateOTLPLine checks a line's OTLP settings
+func ValidateOTLPLine(line OTLPLine) error {
+	return validateOTLPSeverity(line.Severity)
+}
+
+// validateOTLPSeverity checks a severity, unless it uses wildcards and can
+// only be known when the line is sent
+func validateOTLPSeverity(severity string) error {
+	if severity == "" || strings.Contains(severity, "$[") {
+		return nil
+	}
+	if _, ok := otlpSeverities[strings.ToUpper(severity)]; !ok {
+		return errors.New("OTLP Severity must be in (TRACE, DEBUG, INFO, WARN, ERROR, FATAL): " + severity)
+	}
+	return nil
+}
+
+// StartOTLP sets up the OTLP client, resource and batching
+func StartOTLP(conf OTLPConf) error {
+	if conf.Protocol == "" {
+		conf.Protocol = defaultOTLPProtocol
+	}
+	if conf.ServiceName == "" {
+		conf.ServiceName = defaultOTLPServiceName
+	}
+	if conf.HostName == "" {
+		conf.HostName, _ = os.Hostname()
+	}
+	if conf.Severity == "" {
+		conf.Severity = defaultOTLPSeverity
+	}
+
+	if conf.Protocol == "grpc" {
+		creds := insecure.NewCredentials()
+		if conf.TLS.Enabled {
+			config, err := conf.TLS.Config()
+			if err != nil {
+				return err
+			}
+			creds = credentials.NewTLS(config)
+		}
+		conn, err := grpc.NewClient(conf.Endpoint, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return err
+		}
+		otlp.grpc = collogspb.NewLogsServiceClient(conn)
+	} else {
+		otlp.client = &http.Client{Timeout: otlpTimeout}
+		if conf.TLS.Enabled {
+			config, err := conf.TLS.Config()
+			if err != nil {
+				return err
+			}
+			otlp.client.Transport = &http.Transport{TLSClientConfig: config}
+		}
+	}
+
+	otlp.conf = conf
+	otlp.resource = otlpResource(conf)
+	otlp.batcher = newBatcher(conf.BatchSize, conf.BatchMillis, flushOTLP)
+
+	return nil
+}
+
+// otlpResource is the resource every record shares, with the service and
+// host names and the ResourceAttributes, which can override them
+func otlpResource(conf OTLPConf) *resourcepb.Resource {
+	resource := map[string]string{"service.name": conf.ServiceName, "host.name": conf.HostName}
+	for key, value := range conf.ResourceAttributes {
+		resource[key] = value
+	}
+	return &resourcepb.Resource{Attributes: otlpAttributes(resource)}
+}
+
+// sendLogLineOTLP adds the log line to the next OTLP export
+func sendLogLineOTLP(stringBody []byte, params LogLineProperties) {
+	if otlp.batcher == nil {
+		log.Error("OTLP output used without OTLP settings in the global conf, dropping line")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"line": string(stringBody),
+	}).Info("Sending log to OTLP")
+
+	otlp.batcher.add(stringBody, params)
+}
+
+// otlpAttributes turns a map into OTLP string attributes, sorted by key so
+// the same attributes always come out the same way
+func otlpAttributes(values map[string]string) []*commonpb.KeyValue {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	attributes := make([]*commonpb.KeyValue, len(keys))
+	for i, key := range keys {
+		attributes[i] = &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: values[key]}}}
+	}
+	return attributes
+}
+
+// otlpLogRecord maps a rendered line to a LogRecord
+func otlpLogRecord(stringBody []byte, params LogLineProperties) *logspb.LogRecord {
+	scope := loggenmunger.TokenScope{LineID: params.LineID, SourceFile: params.SourceFile, Vars: params.Vars}
+
+	severity := params.OTLP.Severity
+	if severity == "" {
+		severity = otlp.conf.Severity
+	}
+	severity = strings.ToUpper(loggenmunger.RandomizeString(severity, params.TimestampFormat, scope))
+
+	attributes := make(map[string]string, len(params.OTLP.Attributes))
+	for key, value := range params.OTLP.Attributes {
+		attributes[key] = loggenmunger.RandomizeString(value, params.TimestampFormat, scope)
+	}
+
+	// Unknown severities keep their text, but have no number
+	return &logspb.LogRecord{
+		TimeUnixNano:         uint64(params.GeneratedAt.UnixNano()),
+		ObservedTimeUnixNano: uint64(params.GeneratedAt.UnixNano()),
+		SeverityNumber:       otlpSeverities[severity],
+		SeverityText:         severity,
+		Body:                 &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: string(stringBody)}},
+		Attributes:           otlpAttributes(attributes),
+	}
+}
+
+// otlpRequest puts a batch of lines in one export request, under the
+// shared resource
+func otlpRequest(lines []queuedLine) *collogspb.ExportLogsServiceRequest {
+	records := make([]*logspb.LogRecord, len(lines))
+	for i, line := range lines {
+		records[i] = otlpLogRecord(line.body, line.params)
+	}
+
+	return &collogspb.ExportLogsServiceRequest{
+		ResourceLogs: []*logspb.ResourceLogs{{
+			Resource: otlp.resource,
+			ScopeLogs: []*logspb.ScopeLogs{{
+				Scope:      &commonpb.InstrumentationScope{Name: "gologgen"},
+				LogRecords: records,
+			}},
+		}},
+	}
+}
+
+// flushOTLP sends a batch of lines as one export request
+func flushOTLP(lines []queuedLine) {
+	request := otlpRequest(lines)
+	records := len(lines)
+
+	for attempt := 1; attempt <= otlpRetries; attempt++ {
+		var response *collogspb.ExportLogsServiceResponse
+		var retry bool
+		var err error
+		if otlp.conf.Protocol == "grpc" {
+			response, retry, err = exportOTLPGRPC(request)
+		} else {
+			response, retry, err = exportOTLPHTTP(request)
+		}
+
+		if err == nil {
+			// The endpoint doesn't say which records it rejected, so none of
+			// a partly rejected batch is counted as sent
+			if partial := response.GetPartialSuccess(); partial.GetRejectedLogRecords() > 0 || partial.GetErrorMessage() != "" {
+				log.WithFields(log.Fields{
+					"rejected":  partial.GetRejectedLogRecords(),
+					"error_msg": partial.GetErrorMessage(),
+					"records":   records,
+				}).Warn("OTLP endpoint rejected some log records")
+			} else {
+				countSentLines(lines)
+			}
+			log.WithFields(log.Fields{
+				"records": records,
+			}).Debug("OTLP export accepted")
+			return
+		}
+
+		if !retry {
+			log.WithFields(log.Fields{
+				"error_msg": err,
+				"records":   records,
+			}).Error("OTLP endpoint rejected the export")
+			return
+		}
+
+		log.WithFields(log.Fields{
+			"error_msg":     err,
+			"attemptNumber": attempt,
+		}).Warn("OTLP export failed, retrying")
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+
+	log.WithFields(log.Fields{
+		"records": records,
+	}).Error("OTLP export failed and retries ran out, dropping batch")
+}
+
+// exportOTLPHTTP sends an export request over OTLP/HTTP. It also says
+// whether a failure is worth trying again.
+func exportOTLPHTTP(request *collogspb.ExportLogsServiceRequest) (*collogspb.ExportLogsServiceResponse, bool, error) {
+	var body []byte
+	var err error
+	contentType := "application/x-protobuf"
+	if otlp.conf.Protocol == "http/json" {
+		body, err = protojson.Marshal(request)
+		contentType = "application/json"
+	} else {
+		body, err = proto.Marshal(request)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	endpoint := strings.TrimSuffix(otlp.conf.Endpoint, "/")
+	if !strings.HasSuffix(endpoint, otlpLogsPath) {
+		endpoint += otlpLogsPath
+	}
+
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for header, value := range otlp.conf.Headers {
+		req.Header.Set(header, value)
+	}
+
+	resp, err := otlp.client.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+
+	replyBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, err
+	}
+
+	// The spec lists these as the statuses to try again
+	switch {
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode == http.StatusBadGateway,
+		resp.StatusCode == http.StatusServiceUnavailable, resp.StatusCode == http.StatusGatewayTimeout:
+		return nil, true, errors.New("OTLP endpoint responded " + resp.Status)
+	default:
+		return nil, false, errors.New("OTLP endpoint responded " + resp.Status + ": " + string(replyBody))
+	}
+
+	response := &collogspb.ExportLogsServiceResponse{}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		err = protojson.Unmarshal(replyBody, response)
+	} else {
+		err = proto.Unmarshal(replyBody, response)
+	}
+	if err != nil && len(replyBody) > 0 {
+		log.WithFields(log.Fields{
+			"error_msg": err,
+		}).Warn("Couldn't parse the OTLP response")
+	}
+
+	return response, false, nil
+}
+
+// exportOTLPGRPC sends an export request over OTLP/gRPC, with the headers
+// as metadata. It also says whether a failure is worth trying again.
+func exportOTLPGRPC(request *collogspb.ExportLogsServiceRequest) (*collogspb.ExportLogsServiceResponse, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), otlpTimeout)
+	defer cancel()
+	if len(otlp.conf.Headers) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, metadata.New(otlp.conf.Headers))
+	}
+
+	response, err := otlp.grpc.Export(ctx, request)
+	if err != nil {
+		switch status.Code(err) {
+		case codes.Canceled, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted,
+			codes.OutOfRange, codes.Unavailable, codes.DataLoss:
+			return nil, true, err
+		}
+		return nil, false, err
+	}
+	return response, false, nil
+}
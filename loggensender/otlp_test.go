@@ -0,0 +1,103 @@
+package loggensender
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestOTLPLogRecord(t *testing.T) {
+	defer func() { otlp.conf = OTLPConf{} }()
+	otlp.conf = OTLPConf{Severity: "INFO"}
+
+	// 2016-01-01T00:00:00.000000005Z as a fixed64
+	at := time.Date(2016, 1, 1, 0, 0, 0, 5, time.UTC)
+	nanos := []byte{0x05, 0x00, 0xaf, 0x71, 0x54, 0x24, 0x25, 0x14}
+	record := func(fields ...[]byte) []byte {
+		out := append([]byte{0x09}, nanos...)
+		for _, field := range fields {
+			out = append(out, field...)
+		}
+		return append(append(out, 0x59), nanos...)
+	}
+
+	cases := []struct {
+		name   string
+		body   string
+		params LogLineProperties
+		want   []byte
+	}{
+		{
+			"default severity",
+			"plain",
+			LogLineProperties{GeneratedAt: at},
+			record([]byte{0x10, 0x09, 0x1a, 0x04, 'I', 'N', 'F', 'O'},
+				[]byte{0x2a, 0x07, 0x0a, 0x05, 'p', 'l', 'a', 'i', 'n'}),
+		},
+		{
+			// Severities are upper cased, and attribute values can use wildcards
+			"line severity and attributes",
+			"warned",
+			LogLineProperties{GeneratedAt: at, Vars: map[string]string{"item": "shop"}, OTLP: OTLPLine{Severity: "warn", Attributes: map[string]string{"app": "$[var||item]"}}},
+			record([]byte{0x10, 0x0d, 0x1a, 0x04, 'W', 'A', 'R', 'N'},
+				[]byte{0x2a, 0x08, 0x0a, 0x06, 'w', 'a', 'r', 'n', 'e', 'd'},
+				[]byte{0x32, 0x0d, 0x0a, 0x03, 'a', 'p', 'p', 0x12, 0x06, 0x0a, 0x04, 's', 'h', 'o', 'p'}),
+		},
+		{
+			// Unknown severities keep their text without a number
+			"unknown severity",
+			"odd",
+			LogLineProperties{GeneratedAt: at, OTLP: OTLPLine{Severity: "NOTICE"}},
+			record([]byte{0x1a, 0x06, 'N', 'O', 'T', 'I', 'C', 'E'},
+				[]byte{0x2a, 0x05, 0x0a, 0x03, 'o', 'd', 'd'}),
+		},
+	}
+
+	for _, c := range cases {
+		got, err := proto.MarshalOptions{Deterministic: true}.Marshal(otlpLogRecord([]byte(c.body), c.params))
+		if err != nil || !bytes.Equal(got, c.want) {
+			t.Errorf("Failed case: %s: % x >> % x (%v)", c.name, c.want, got, err)
+		}
+	}
+}
+
+func TestOTLPRequest(t *testing.T) {
+	defer func() { otlp.conf, otlp.resource = OTLPConf{}, nil }()
+
+	// ResourceAttributes are added to the service and host names, and can
+	// override them
+	otlp.conf = OTLPConf{ServiceName: "checkout", HostName: "web-1", Severity: "INFO", ResourceAttributes: map[string]string{"deployment.environment": "prod", "host.name": "web-2"}}
+	otlp.resource = otlpResource(otlp.conf)
+
+	at := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	lines := []queuedLine{
+		{body: []byte("first"), params: LogLineProperties{GeneratedAt: at}},
+		{body: []byte("second"), params: LogLineProperties{GeneratedAt: at.Add(time.Second), OTLP: OTLPLine{Severity: "ERROR", Attributes: map[string]string{"user": "alice"}}}},
+	}
+
+	// This is what the http/json protocol sends
+	want := `{"resourceLogs":[{` +
+		`"resource":{"attributes":[` +
+		`{"key":"deployment.environment","value":{"stringValue":"prod"}},` +
+		`{"key":"host.name","value":{"stringValue":"web-2"}},` +
+		`{"key":"service.name","value":{"stringValue":"checkout"}}]},` +
+		`"scopeLogs":[{"scope":{"name":"gologgen"},"logRecords":[` +
+		`{"timeUnixNano":"1451606400000000000","observedTimeUnixNano":"1451606400000000000","severityNumber":"SEVERITY_NUMBER_INFO","severityText":"INFO","body":{"stringValue":"first"}},` +
+		`{"timeUnixNano":"1451606401000000000","observedTimeUnixNano":"1451606401000000000","severityNumber":"SEVERITY_NUMBER_ERROR","severityText":"ERROR","body":{"stringValue":"second"},` +
+		`"attributes":[{"key":"user","value":{"stringValue":"alice"}}]}]}]}]}`
+
+	encoded, err := protojson.Marshal(otlpRequest(lines))
+	if err != nil {
+		t.Fatalf("Failed case: encoding >> %v", err)
+	}
+	// protojson varies its spacing on purpose, so it's taken out
+	var got bytes.Buffer
+	json.Compact(&got, encoded)
+	if got.String() != want {
+		t.Errorf("Failed case: %s >> %s", want, got.String())
+	}
+}
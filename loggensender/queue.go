@@ -0,0 +1,383 @@
+package loggensender
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// OutputQueueConf sets the size of an output's queue, how many lines it
+// sends at once, and what happens when it fills up
+type OutputQueueConf struct {
+	Size      int    `json:"Size"`
+	Senders   int    `json:"Senders"`
+	Policy    string `json:"Policy"`
+	SpillPath string `json:"SpillPath"`
+}
+
+// Defaults for outputs that don't have their own OutputQueueConf
+const (
+	defaultQueueSize    = 1000
+	defaultQueueSenders = 10
+	defaultQueuePolicy  = "block"
+)
+
+// dropReportInterval is how often an output queue warns about dropped lines
+const dropReportInterval = 10 * time.Second
+
+// outputSenders are the outputs that get a queue, and how each one sends a line
+var outputSenders = map[string]func(stringBody []byte, params LogLineProperties){
+	"http":          sendLogLineHTTP,
+	"syslog":        sendLogLineSyslog,
+	"file":          sendLogLineFile,
+	"kafka":         sendLogLineKafka,
+	"hec":           sendLogLineHEC,
+	"elasticsearch": sendLogLineElasticsearch,
+	"loki":          sendLogLineLoki,
+	"otlp":          sendLogLineOTLP,
+	"gelf":          sendLogLineGELF,
+	"fluent":        sendLogLineFluent,
+}
+
+// outputQueues holds the running queue of each output
+var outputQueues = make(map[string]*OutputQueue)
+
+// unqueuedDropped counts the lines dropped because their output had no queue
+var unqueuedDropped int64
+
+// queuedLine is a rendered line waiting to be sent
+type queuedLine struct {
+	body   []byte
+	params LogLineProperties
+}
+
+// spilledLine is how a queued line is written to the spill file, with the
+// properties it was generated with. Those that aren't read from a data file
+// are written out on their own, apart from the HTTP client every line
+// shares, which the queue keeps.
+type spilledLine struct {
+	Body        []byte            `json:"Body"`
+	Params      LogLineProperties `json:"Params"`
+	GeneratedAt time.Time         `json:"GeneratedAt"`
+	ScheduledAt time.Time         `json:"ScheduledAt"`
+	Vars        map[string]string `json:"Vars"`
+	Scenario    string            `json:"Scenario"`
+	Replay      bool              `json:"Replay"`
+	TargetRate  bool              `json:"TargetRate"`
+}
+
+// OutputQueue is a bounded queue of rendered lines in front of an output
+type OutputQueue struct {
+	name    string
+	conf    OutputQueueConf
+	lines   chan queuedLine
+	senders sync.WaitGroup
+	dropped int64
+	spilled int64
+
+	// Spill file state, only used by the spill policy
+	spillMu      sync.Mutex
+	spillCond    *sync.Cond
+	spillEmpty   *sync.Cond
+	spillWriter  *os.File
+	spillReader  *bufio.Reader
+	spillPending int
+	spillClient  *http.Client
+}
+
+// OutputTypes lists the names of all the outputs, in alphabetical order
+func OutputTypes() []string {
+	var outputs []string
+	for output := range outputSenders {
+		outputs = append(outputs, output)
+	}
+	sort.Strings(outputs)
+	return outputs
+}
+
+// targetRateSent counts the target rate lines the outputs have sent
+var targetRateSent int64
+
+// TargetRateSent counts the lines sent for the target rate that an output
+// has sent successfully, leaving out lines that were dropped or failed
+func TargetRateSent() int64 {
+	return atomic.LoadInt64(&targetRateSent)
+}
+
+// countSent is called by the outputs for each line they've sent successfully
+func countSent(params LogLineProperties) {
+	if params.TargetRate {
+		atomic.AddInt64(&targetRateSent, 1)
+	}
+}
+
+// countSentLines counts a batch of lines that were sent successfully
+func countSentLines(lines []queuedLine) {
+	for _, line := range lines {
+		countSent(line.params)
+	}
+}
+
+// IsOutputType checks that an output with the given name exists
+func IsOutputType(output string) bool {
+	_, ok := outputSenders[output]
+	return ok
+}
+
+// ValidateOutputQueue checks the queue settings for an output
+func ValidateOutputQueue(output string, conf OutputQueueConf) error {
+	if !IsOutputType(output) {
+		return errors.New("Output queues can only be set for known outputs, not " + output)
+	}
+	if conf.Size < 0 || conf.Senders < 0 {
+		return errors.New("Queue Size and Senders cannot be negative")
+	}
+
+	switch conf.Policy {
+	case "", "block", "drop_newest", "drop_oldest":
+	case "spill":
+		if conf.SpillPath == "" {
+			return errors.New("The spill policy needs a SpillPath")
+		}
+	default:
+		return errors.New("Queue Policy must be in (block, drop_newest, drop_oldest, spill): " + conf.Policy)
+	}
+
+	return nil
+}
+
+// StartOutputQueues creates a queue for every output, with its senders.
+// Outputs without settings in confs get the default queue.
+func StartOutputQueues(confs map[string]OutputQueueConf) error {
+	for output := range outputSenders {
+		conf := confs[output]
+		if conf.Size == 0 {
+			conf.Size = defaultQueueSize
+		}
+		if conf.Senders == 0 {
+			conf.Senders = defaultQueueSenders
+		}
+		if conf.Policy == "" {
+			conf.Policy = defaultQueuePolicy
+		}
+
+		queue, err := newOutputQueue(output, conf)
+		if err != nil {
+			return err
+		}
+		outputQueues[output] = queue
+	}
+
+	return nil
+}
+
+// StopOutputQueues waits for each queue to send the lines it's holding,
+// spilled lines included, and stops its senders. Nothing can be added to
+// the queues once they're stopped.
+func StopOutputQueues() {
+	for _, q := range outputQueues {
+		if q.spillEmpty != nil {
+			q.spillMu.Lock()
+			for q.spillPending > 0 {
+				q.spillEmpty.Wait()
+			}
+			q.spillMu.Unlock()
+		}
+		close(q.lines)
+		q.senders.Wait()
+	}
+	outputQueues = make(map[string]*OutputQueue)
+}
+
+// newOutputQueue creates a queue and starts sending from it
+func newOutputQueue(output string, conf OutputQueueConf) (*OutputQueue, error) {
+	q := &OutputQueue{name: output, conf: conf, lines: make(chan queuedLine, conf.Size)}
+
+	if conf.Policy == "spill" {
+		writer, err := os.Create(conf.SpillPath)
+		if err != nil {
+			return nil, err
+		}
+		reader, err := os.Open(conf.SpillPath)
+		if err != nil {
+			return nil, err
+		}
+		q.spillWriter = writer
+		q.spillReader = bufio.NewReader(reader)
+		q.spillCond = sync.NewCond(&q.spillMu)
+		q.spillEmpty = sync.NewCond(&q.spillMu)
+		go q.unspill(reader)
+	}
+
+	send := outputSenders[output]
+	q.senders.Add(conf.Senders)
+	for i := 0; i < conf.Senders; i++ {
+		go func() {
+			defer q.senders.Done()
+			for line := range q.lines {
+				send(line.body, line.params)
+			}
+		}()
+	}
+
+	go q.reportDrops()
+
+	return q, nil
+}
+
+// enqueue adds a rendered line to the queue, following the queue's policy if
+// it's full
+func (q *OutputQueue) enqueue(line queuedLine) {
+	switch q.conf.Policy {
+	case "drop_newest":
+		select {
+		case q.lines <- line:
+		default:
+			atomic.AddInt64(&q.dropped, 1)
+		}
+	case "drop_oldest":
+		for {
+			select {
+			case q.lines <- line:
+				return
+			default:
+			}
+			// Make room by throwing away the line at the front of the queue
+			select {
+			case <-q.lines:
+				atomic.AddInt64(&q.dropped, 1)
+			default:
+			}
+		}
+	case "spill":
+		q.spillMu.Lock()
+		defer q.spillMu.Unlock()
+		// Once lines are spilling, new lines go after them to keep the order
+		if q.spillPending == 0 {
+			select {
+			case q.lines <- line:
+				return
+			default:
+			}
+		}
+		q.spill(line)
+	default:
+		q.lines <- line
+	}
+}
+
+// spill appends a line to the spill file. The caller holds spillMu.
+func (q *OutputQueue) spill(line queuedLine) {
+	// The line's already rendered, so its JSON fields aren't needed again,
+	// and the HTTP client can't be written out
+	params := line.params
+	stored := params
+	stored.Fields = nil
+	stored.HTTPClient = nil
+	record, err := json.Marshal(spilledLine{
+		Body:        line.body,
+		Params:      stored,
+		GeneratedAt: params.GeneratedAt,
+		ScheduledAt: params.ScheduledAt,
+		Vars:        params.Vars,
+		Scenario:    params.Scenario,
+		Replay:      params.Replay,
+		TargetRate:  params.TargetRate,
+	})
+	if err == nil {
+		_, err = q.spillWriter.Write(append(record, '\n'))
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"output":    q.name,
+			"error_msg": err,
+		}).Error("Couldn't write to the spill file, dropping line")
+		atomic.AddInt64(&q.dropped, 1)
+		return
+	}
+
+	if params.HTTPClient != nil {
+		q.spillClient = params.HTTPClient
+	}
+	q.spillPending++
+	atomic.AddInt64(&q.spilled, 1)
+	q.spillCond.Signal()
+}
+
+// unspill moves spilled lines back into the queue as it empties, and empties
+// the spill file whenever it's caught up
+func (q *OutputQueue) unspill(reader *os.File) {
+	for {
+		q.spillMu.Lock()
+		for q.spillPending == 0 {
+			q.spillWriter.Truncate(0)
+			q.spillWriter.Seek(0, 0)
+			reader.Seek(0, 0)
+			q.spillReader.Reset(reader)
+			q.spillCond.Wait()
+		}
+
+		record, err := q.spillReader.ReadBytes('\n')
+		var spilled spilledLine
+		if err == nil {
+			err = json.Unmarshal(record, &spilled)
+		}
+		client := q.spillClient
+		q.spillMu.Unlock()
+
+		if err != nil {
+			log.WithFields(log.Fields{
+				"output":    q.name,
+				"error_msg": err,
+			}).Error("Couldn't read a line back from the spill file, dropping line")
+			atomic.AddInt64(&q.dropped, 1)
+		} else {
+			params := spilled.Params
+			params.GeneratedAt = spilled.GeneratedAt
+			params.ScheduledAt = spilled.ScheduledAt
+			params.Vars = spilled.Vars
+			params.Scenario = spilled.Scenario
+			params.Replay = spilled.Replay
+			params.TargetRate = spilled.TargetRate
+			params.HTTPClient = client
+			q.lines <- queuedLine{body: spilled.Body, params: params}
+		}
+
+		// A line counts as spilled until it's back in the queue, so new
+		// lines keep going after it, and stopping waits for it
+		q.spillMu.Lock()
+		q.spillPending--
+		if q.spillPending == 0 {
+			q.spillEmpty.Broadcast()
+		}
+		q.spillMu.Unlock()
+	}
+}
+
+// reportDrops warns every so often if the queue has dropped or spilled lines
+func (q *OutputQueue) reportDrops() {
+	var lastDropped, lastSpilled int64
+	for range time.Tick(dropReportInterval) {
+		dropped := atomic.LoadInt64(&q.dropped)
+		spilled := atomic.LoadInt64(&q.spilled)
+		if dropped > lastDropped || spilled > lastSpilled {
+			log.WithFields(log.Fields{
+				"output":        q.name,
+				"dropped":       dropped - lastDropped,
+				"spilled":       spilled - lastSpilled,
+				"total_dropped": dropped,
+				"total_spilled": spilled,
+			}).Warn("Output queue was full")
+		}
+		lastDropped = dropped
+		lastSpilled = spilled
+	}
+}
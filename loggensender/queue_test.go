@@ -0,0 +1,92 @@
+package loggensender
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOutputQueueSpill(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	// Without senders, the first line fills the queue and the rest spill
+	q, err := newOutputQueue("http", OutputQueueConf{Size: 1, Policy: "spill", SpillPath: filepath.Join(dir, "spill")})
+	if err != nil {
+		t.Fatalf("Failed case: starting >> %v", err)
+	}
+
+	// Lines from the same data file line each keep their own properties
+	client := &http.Client{}
+	base := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		body string
+		user string
+	}{
+		{"queued", "alice"},
+		{"spilled first", "bob"},
+		{"spilled second", "carol"},
+	}
+	for i, c := range cases {
+		at := base.Add(time.Duration(i) * time.Second)
+		params := LogLineProperties{LineID: "line", GeneratedAt: at, ScheduledAt: at, Vars: map[string]string{"user": c.user}, TargetRate: true, HTTPClient: client}
+		q.enqueue(queuedLine{body: []byte(c.body), params: params})
+	}
+
+	for i, c := range cases {
+		var line queuedLine
+		select {
+		case line = <-q.lines:
+		case <-time.After(time.Second):
+			t.Fatalf("Failed case: %s wasn't fed back from the spill file", c.body)
+		}
+
+		at := base.Add(time.Duration(i) * time.Second)
+		params := line.params
+		if string(line.body) != c.body || params.Vars["user"] != c.user || !params.GeneratedAt.Equal(at) || !params.ScheduledAt.Equal(at) {
+			t.Errorf("Failed case: {%s,%s,%v} >> {%s,%s,%v}", c.body, c.user, at, line.body, params.Vars["user"], params.ScheduledAt)
+		}
+		if !params.TargetRate || params.HTTPClient != client {
+			t.Errorf("Failed case: %s lost its target rate mark or HTTP client", c.body)
+		}
+	}
+}
+
+func TestStopOutputQueues(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	var sent []string
+	outputSenders["test"] = func(stringBody []byte, params LogLineProperties) {
+		sent = append(sent, string(stringBody))
+	}
+	defer delete(outputSenders, "test")
+
+	// One sender keeps the order. The queue holds one line, so most of
+	// them spill and have to be fed back before stopping can finish.
+	q, err := newOutputQueue("test", OutputQueueConf{Size: 1, Senders: 1, Policy: "spill", SpillPath: filepath.Join(dir, "spill")})
+	if err != nil {
+		t.Fatalf("Failed case: starting >> %v", err)
+	}
+	outputQueues = map[string]*OutputQueue{"test": q}
+
+	want := []string{"one", "two", "three", "four", "five"}
+	for _, body := range want {
+		q.enqueue(queuedLine{body: []byte(body)})
+	}
+	StopOutputQueues()
+
+	if len(sent) != len(want) {
+		t.Fatalf("Failed case: sent %v >> %v", want, sent)
+	}
+	for i := range want {
+		if sent[i] != want[i] {
+			t.Errorf("Failed case: sent %v >> %v", want, sent)
+			break
+		}
+	}
+	if len(outputQueues) != 0 {
+		t.Errorf("Failed case: stopped queues were kept")
+	}
+}
@@ -0,0 +1,44 @@
+package loggensender
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+// TLSConf holds the TLS settings for outputs that support it
+type TLSConf struct {
+	Enabled            bool   `json:"Enabled"`
+	CAFile             string `json:"CAFile"`
+	CertFile           string `json:"CertFile"`
+	KeyFile            string `json:"KeyFile"`
+	InsecureSkipVerify bool   `json:"InsecureSkipVerify"`
+}
+
+// Config builds a tls.Config from the settings, loading the CA and client
+// certificate files if they're given
+func (c TLSConf) Config() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+
+	if c.CAFile != "" {
+		caCert, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, errors.New("No PEM certificates found in CAFile " + c.CAFile)
+		}
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
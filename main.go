@@ -3,18 +3,22 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"math"
-	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/ftwynn/gologgen/loggenmunger"
 	"github.com/ftwynn/gologgen/loggensender"
 
 	log "github.com/Sirupsen/logrus"
@@ -25,15 +29,28 @@ var workers int
 
 // GlobalConfStore holds all the config data from the conf file
 type GlobalConfStore struct {
-	HTTPLoc        string               `json:"httpLoc"`
-	OutputType     string               `json:"OutputType"`
-	SyslogType     string               `json:"SyslogType"`
-	SyslogLoc      string               `json:"SyslogLoc"`
-	FileOutputPath string               `json:"FileOutputPath"`
-	DataFiles      []DataFileMetaData   `json:"DataFiles"`
-	ReplayFiles    []ReplayFileMetaData `json:"ReplayFiles"`
+	HTTPLoc        string                                  `json:"httpLoc"`
+	OutputType     string                                  `json:"OutputType"`
+	SyslogType     string                                  `json:"SyslogType"`
+	SyslogLoc      string                                  `json:"SyslogLoc"`
+	Elasticsearch  loggensender.ElasticsearchConf          `json:"Elasticsearch"`
+	Loki           loggensender.LokiConf                   `json:"Loki"`
+	OTLP           loggensender.OTLPConf                   `json:"OTLP"`
+	GELF           loggensender.GELFConf                   `json:"GELF"`
+	Fluent         loggensender.FluentConf                 `json:"Fluent"`
+	HEC            loggensender.HECConf                    `json:"HEC"`
+	Kafka          loggensender.KafkaConf                  `json:"Kafka"`
+	FileOutputPath string                                  `json:"FileOutputPath"`
+	FileOutput     loggensender.FileOutputConf             `json:"FileOutput"`
+	DataFiles      []DataFileMetaData                      `json:"DataFiles"`
+	ReplayFiles    []ReplayFileMetaData                    `json:"ReplayFiles"`
+	Dictionaries   []loggenmunger.DictionaryMetaData       `json:"Dictionaries"`
+	Scenarios      []Scenario                              `json:"Scenarios"`
+	RateProfiles   []RateProfile                           `json:"RateProfiles"`
+	RateProfile    string                                  `json:"RateProfile"`
+	TargetRate     *TargetRateConf                         `json:"TargetRate"`
+	OutputQueues   map[string]loggensender.OutputQueueConf `json:"OutputQueues"`
 	HTTPClient     http.Client
-	FileHandler    *os.File
 }
 
 // DataFileMetaData stores the configs around data files
@@ -48,14 +65,19 @@ type ReplayFileMetaData struct {
 	TimestampFormat string                           `json:"TimestampFormat"`
 	RepeatInterval  int                              `json:"RepeatInterval"`
 	Headers         []loggensender.LogLineHTTPHeader `json:"Headers"`
+	DisableTokens   bool                             `json:"DisableTokens"`
+	FilePath        string                           `json:"FilePath"`
 }
 
 // LogGenDataFile represents a data file
 type LogGenDataFile struct {
 	Lines []loggensender.LogLineProperties `json:"lines"`
+	Flows []FlowDefinition                 `json:"flows"`
 }
 
-func init() {
+// parseFlags reads the command line. It's called from main rather than init
+// so that tests can run with their own flags.
+func parseFlags() {
 	// Set global logging levels by the flag, default to WARN if not defined
 	var level string
 	flag.StringVar(&level, "level", "WARN", "Log level for the gologgen program itself")
@@ -82,8 +104,10 @@ func init() {
 	}
 }
 
-// InitializeRunTable will take a slice of LogLines and start times and put the various lines in their starting slots in the map
-func queueLogLines(Lines []loggensender.LogLineProperties, tickerStart time.Time, runQueue chan loggensender.LogLineProperties) {
+// InitializeRunTable will take a slice of LogLines and start times and put the various lines in their starting slots in the scheduler
+func queueLogLines(Lines []loggensender.LogLineProperties, tickerStart time.Time, scheduler *lineScheduler) {
+	re := regexp.MustCompile(`\d+`)
+
 	for _, line := range Lines {
 		log.Debug("========== New Line ==========")
 		log.WithFields(log.Fields{
@@ -97,13 +121,11 @@ func queueLogLines(Lines []loggensender.LogLineProperties, tickerStart time.Time
 			targetTime = tickerStart
 		} else {
 			// Use regex to take in what the start time should be
-			re := regexp.MustCompile(`\d+`)
 			targetHourMinSec := re.FindAllString(line.StartTime, -1)
 			targetHour, _ := strconv.Atoi(targetHourMinSec[0])
 			targetMin, _ := strconv.Atoi(targetHourMinSec[1])
 			targetSec, _ := strconv.Atoi(targetHourMinSec[2])
-			loc, _ := time.LoadLocation("America/Los_Angeles")
-			targetTime = time.Date(time.Now().Year(), time.Now().Month(), time.Now().Day(), targetHour, targetMin, targetSec, 0, loc).Truncate(time.Second)
+			targetTime = time.Date(time.Now().Year(), time.Now().Month(), time.Now().Day(), targetHour, targetMin, targetSec, 0, time.Local).Truncate(time.Second)
 		}
 
 		log.WithFields(log.Fields{
@@ -120,80 +142,43 @@ func queueLogLines(Lines []loggensender.LogLineProperties, tickerStart time.Time
 			"diff": diff,
 		}).Debug("The diff between target and tickerStart is")
 
-		diffMod := int(math.Abs(float64(int(diff.Seconds()) % line.IntervalSecs)))
+		// Validation drops lines without a positive interval, but don't
+		// divide by zero if one gets through
+		var diffMod time.Duration
+		if intervalMillis, _ := lineIntervalMillis(line); int64(intervalMillis) > 0 {
+			diffMod = time.Duration(math.Abs(float64(int64(diff/time.Millisecond)%int64(intervalMillis)))) * time.Millisecond
+		}
 
 		switch {
 		case targetTime.Equal(tickerStart) || targetTime.After(tickerStart):
 			log.Debug("Target is equal to or after start, so queuing with target time")
-			go sleepAndSend(runQueue, targetTime, line)
+			scheduler.add(line, targetTime)
 		case targetTime.Before(tickerStart):
 			if diffMod == 0 {
 				log.Debug("TickerStart is a multiple of Target's interval, so setting to TickerStart")
-				go sleepAndSend(runQueue, tickerStart, line)
+				scheduler.add(line, tickerStart)
 			} else {
 				log.WithFields(log.Fields{
-					"startTime": tickerStart.Add(time.Duration(diffMod) * time.Second),
+					"startTime": tickerStart.Add(diffMod),
 				}).Debug("Setting a start after ticker start")
-				go sleepAndSend(runQueue, tickerStart.Add(time.Duration(diffMod)*time.Second), line)
+				scheduler.add(line, tickerStart.Add(diffMod))
 			}
 		}
 
 	}
 }
 
-func sleepAndSend(runQueue chan loggensender.LogLineProperties, targetTime time.Time, logline loggensender.LogLineProperties) {
-	currentTime := time.Now()
-
-	log.WithFields(log.Fields{
-		"line":        logline.Text,
-		"targetTime":  targetTime,
-		"currentTime": currentTime,
-	}).Debug("Starting new sleepAndSend")
-
-	time.Sleep(targetTime.Sub(currentTime))
-
-	log.WithFields(log.Fields{
-		"line":       logline.Text,
-		"targetTime": targetTime,
-	}).Debug("Queuing line")
-
-	runQueue <- logline
-
-	// Calculate next run time
-	// Randomize the Interval by specifying the std dev and adding the desired mean
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
-	var milliseconds int
-	if logline.IntervalMillis != 0 {
-		milliseconds = logline.IntervalSecs
-	} else {
-		milliseconds = logline.IntervalSecs * 1000
-	}
-	var stdDevMilli int
-	if logline.IntervalMillis != 0 {
-		stdDevMilli = logline.IntervalStdDevMillis
-	} else {
-		stdDevMilli = int(logline.IntervalStdDev * 1000.0)
-	}
-	nextInterval := int(r.NormFloat64()*float64(stdDevMilli) + float64(milliseconds))
-	nextTime := targetTime.Add(time.Duration(nextInterval) * time.Millisecond)
-	log.WithFields(log.Fields{
-		"line":     logline.Text,
-		"nextTime": nextTime,
-	}).Debug("SCHEDULED - Next log run")
-
-	go sleepAndSend(runQueue, nextTime, logline)
-}
-
-// storeDataFileLogLines takes the conf data, gets the associated files, and puts them in a big list of LogLine Objects
-func parseAndStoreLogLines(confData GlobalConfStore, targetStartTime time.Time) (logLines []loggensender.LogLineProperties) {
+// storeDataFileLogLines takes the conf data, gets the associated files, and puts them in a big list of LogLine Objects,
+// along with a list of any flows found in the data files
+func parseAndStoreLogLines(confData GlobalConfStore, targetStartTime time.Time) (logLines []loggensender.LogLineProperties, flows []FlowDefinition) {
 	log.WithFields(log.Fields{
 		"confData": confData,
 	}).Info("Entering parseAndQueueLogLines")
 
-	dataJSON := LogGenDataFile{}
-
 	// First, read in any data files
 	for _, dataFile := range confData.DataFiles {
+		dataJSON := LogGenDataFile{}
+
 		dataText, err := ioutil.ReadFile(dataFile.Path)
 		if err != nil {
 			log.WithFields(log.Fields{
@@ -213,11 +198,23 @@ func parseAndStoreLogLines(confData GlobalConfStore, targetStartTime time.Time)
 			continue
 		}
 
+		// IDs are set first, so they follow the lines in the file even if
+		// some are dropped
+		for i := 0; i < len(dataJSON.Lines); i++ {
+			dataJSON.Lines[i].LineID = dataFile.Path + ":" + strconv.Itoa(i)
+			dataJSON.Lines[i].SourceFile = dataFile.Path
+		}
+
 		validateDataFile(&dataJSON)
 
 		// Add the parsed fields to the queue
-		for i := 0; i < len(dataJSON.Lines); i++ {
-			logLines = append(logLines, dataJSON.Lines[i])
+		logLines = append(logLines, dataJSON.Lines...)
+
+		validateFlows(dataJSON.Flows)
+
+		for i := 0; i < len(dataJSON.Flows); i++ {
+			dataJSON.Flows[i].SourceFile = dataFile.Path
+			flows = append(flows, dataJSON.Flows[i])
 		}
 	}
 
@@ -241,8 +238,10 @@ func parseAndStoreLogLines(confData GlobalConfStore, targetStartTime time.Time)
 		log.WithFields(log.Fields{
 			"path": replayFile.Path,
 		}).Debug("Scanning replay file")
+		lineNumber := 0
 		for scanner.Scan() {
 			line := scanner.Text()
+			lineNumber++
 			log.WithFields(log.Fields{
 				"line": line,
 			}).Debug("Current replay line")
@@ -277,13 +276,28 @@ func parseAndStoreLogLines(confData GlobalConfStore, targetStartTime time.Time)
 				"startTime": startTime,
 			}).Debug("New Start Time")
 
+			// Escape anything that looks like a token if the file should be sent as is
+			if replayFile.DisableTokens {
+				line = loggenmunger.EscapeTokens(line)
+			}
+
 			// Replace the line with the $[time||stamp] token for replacement
 			augmentedLine := timeRegex.ReplaceAllString(line, "$[time||stamp]")
 			log.WithFields(log.Fields{
 				"augmentedLine": augmentedLine,
 			}).Debug("New augmented line")
 
-			logLine := loggensender.LogLineProperties{Text: augmentedLine, IntervalSecs: replayFile.RepeatInterval, IntervalStdDev: 0, StartTime: startTime, TimestampFormat: replayFile.TimestampFormat, Headers: replayFile.Headers}
+			// Lines with wildcards that can't be rendered are left out
+			if err := loggenmunger.ValidateTokens(augmentedLine); err != nil {
+				log.WithFields(log.Fields{
+					"path":       replayFile.Path,
+					"lineNumber": lineNumber,
+					"error_msg":  err,
+				}).Error("Replay line has an invalid wildcard, so dropping it")
+				continue
+			}
+
+			logLine := loggensender.LogLineProperties{Text: augmentedLine, IntervalSecs: replayFile.RepeatInterval, IntervalStdDev: 0, StartTime: startTime, TimestampFormat: replayFile.TimestampFormat, Headers: replayFile.Headers, LineID: replayFile.Path + ":" + strconv.Itoa(lineNumber), SourceFile: replayFile.Path, FilePath: replayFile.FilePath, Replay: true}
 
 			logLines = append(logLines, logLine)
 
@@ -292,33 +306,53 @@ func parseAndStoreLogLines(confData GlobalConfStore, targetStartTime time.Time)
 
 	// Set individual log lines to global configs / defaults if need be
 	for i := 0; i < len(logLines); i++ {
-		logLines[i].HTTPClient = &confData.HTTPClient
-		logLines[i].FileHandler = confData.FileHandler
+		applyLineDefaults(&logLines[i], &confData)
 
-		if logLines[i].OutputType == "" {
-			logLines[i].OutputType = confData.OutputType
-		}
-		if logLines[i].HTTPLoc == "" {
-			logLines[i].HTTPLoc = confData.HTTPLoc
-		}
-		if logLines[i].SyslogType == "" {
-			logLines[i].SyslogType = confData.SyslogType
-		}
-		if logLines[i].SyslogLoc == "" {
-			logLines[i].SyslogLoc = confData.SyslogLoc
+		if logLines[i].OutputType == "file" && logLines[i].FilePath == "" {
+			log.WithFields(log.Fields{
+				"LineID": logLines[i].LineID,
+			}).Fatal("Lines using the file output need a FilePath, or a FileOutputPath in the global config")
 		}
 		if logLines[i].StartTime == "" {
 			logLines[i].StartTime = targetStartTime.Format("15:04:05")
 		}
-
+	}
+	for i := 0; i < len(flows); i++ {
+		prepareFlowSteps(&flows[i], &confData)
 	}
 
 	log.WithFields(log.Fields{
 		"count": len(logLines),
+		"flows": len(flows),
 	}).Info("Finished storing normalized log lines")
 	return
 }
 
+// applyLineDefaults sets the output configs of a log line to the global configs if they're not already set
+func applyLineDefaults(logLine *loggensender.LogLineProperties, confData *GlobalConfStore) {
+	logLine.HTTPClient = &confData.HTTPClient
+
+	if logLine.OutputType == "" {
+		logLine.OutputType = confData.OutputType
+	}
+	if logLine.HTTPLoc == "" {
+		logLine.HTTPLoc = confData.HTTPLoc
+	}
+	if logLine.SyslogType == "" {
+		logLine.SyslogType = confData.SyslogType
+	}
+	if logLine.SyslogLoc == "" {
+		logLine.SyslogLoc = confData.SyslogLoc
+	}
+	if logLine.FilePath == "" {
+		logLine.FilePath = confData.FileOutputPath
+	}
+	// Replay lines keep their captured timing, so the global profile doesn't apply
+	if logLine.RateProfile == "" && !logLine.Replay {
+		logLine.RateProfile = confData.RateProfile
+	}
+}
+
 // validateConfFile ONLY does sanity checks on the values inside the conf file.
 // The data file validation is handled elsewhere
 func validateConfFile(confData *GlobalConfStore) {
@@ -333,10 +367,10 @@ func validateConfFile(confData *GlobalConfStore) {
 	}
 
 	// Confirm the OutputType is valid
-	if confData.OutputType != "http" && confData.OutputType != "syslog" && confData.OutputType != "file" {
+	if !loggensender.IsOutputType(confData.OutputType) {
 		log.WithFields(log.Fields{
 			"OutputType": confData.OutputType,
-		}).Fatal("Output type in global conf is not in (http, syslog, file)")
+		}).Fatal("Output type in global conf is not in (" + strings.Join(loggensender.OutputTypes(), ", ") + ")")
 	}
 
 	// Confirm the HTTP Location is valid
@@ -360,9 +394,100 @@ func validateConfFile(confData *GlobalConfStore) {
 		}).Fatal("Syslog type in global conf is not in (tcp, udp)")
 	}
 
-	// Confirm File Location is valid
-	if confData.OutputType == "file" && confData.FileOutputPath == "" {
-		log.Fatal("The output file path must be present, and non-blank in the global config if using the file output method")
+	// Confirm File Locations are valid. Lines without their own FilePath are
+	// checked for the FileOutputPath once they're loaded.
+	if err := loggenmunger.ValidateDatePattern(confData.FileOutputPath); err != nil {
+		log.WithFields(log.Fields{
+			"FileOutputPath": confData.FileOutputPath,
+			"error_msg":      err,
+		}).Fatal("The output file path in the global config has a bad date part")
+	}
+	for _, replayFile := range confData.ReplayFiles {
+		if err := loggenmunger.ValidateDatePattern(replayFile.FilePath); err != nil {
+			log.WithFields(log.Fields{
+				"path":      replayFile.Path,
+				"FilePath":  replayFile.FilePath,
+				"error_msg": err,
+			}).Fatal("The FilePath of a replay file has a bad date part")
+		}
+	}
+	// Confirm the wildcards in the global settings are valid
+	for _, field := range confTokenFields(confData) {
+		if err := loggenmunger.ValidateTokens(field); err != nil {
+			log.WithFields(log.Fields{
+				"field":     field,
+				"error_msg": err,
+			}).Fatal("A wildcard in the global config is not valid")
+		}
+	}
+
+	if err := loggensender.ValidateFileOutputConf(confData.FileOutput); err != nil {
+		log.WithFields(log.Fields{
+			"error_msg": err,
+		}).Fatal("The FileOutput settings in the global config are not valid")
+	}
+
+	// Confirm the Elasticsearch settings are valid if they're used
+	if confData.OutputType == "elasticsearch" || len(confData.Elasticsearch.URLs) > 0 {
+		if err := loggensender.ValidateElasticsearchConf(confData.Elasticsearch); err != nil {
+			log.WithFields(log.Fields{
+				"error_msg": err,
+			}).Fatal("The Elasticsearch settings in the global config are not valid")
+		}
+	}
+
+	// Confirm the Loki settings are valid if they're used
+	if confData.OutputType == "loki" || confData.Loki.URL != "" {
+		if err := loggensender.ValidateLokiConf(confData.Loki); err != nil {
+			log.WithFields(log.Fields{
+				"error_msg": err,
+			}).Fatal("The Loki settings in the global config are not valid")
+		}
+	}
+
+	// Confirm the OTLP settings are valid if they're used
+	if confData.OutputType == "otlp" || confData.OTLP.Endpoint != "" {
+		if err := loggensender.ValidateOTLPConf(confData.OTLP); err != nil {
+			log.WithFields(log.Fields{
+				"error_msg": err,
+			}).Fatal("The OTLP settings in the global config are not valid")
+		}
+	}
+
+	// Confirm the GELF settings are valid if they're used
+	if confData.OutputType == "gelf" || confData.GELF.Address != "" {
+		if err := loggensender.ValidateGELFConf(confData.GELF); err != nil {
+			log.WithFields(log.Fields{
+				"error_msg": err,
+			}).Fatal("The GELF settings in the global config are not valid")
+		}
+	}
+
+	// Confirm the Fluent settings are valid if they're used
+	if confData.OutputType == "fluent" || confData.Fluent.Address != "" {
+		if err := loggensender.ValidateFluentConf(confData.Fluent); err != nil {
+			log.WithFields(log.Fields{
+				"error_msg": err,
+			}).Fatal("The Fluent settings in the global config are not valid")
+		}
+	}
+
+	// Confirm the HEC settings are valid if they're used
+	if confData.OutputType == "hec" || confData.HEC.URL != "" {
+		if err := loggensender.ValidateHECConf(confData.HEC); err != nil {
+			log.WithFields(log.Fields{
+				"error_msg": err,
+			}).Fatal("The HEC settings in the global config are not valid")
+		}
+	}
+
+	// Confirm the Kafka settings are valid if they're used
+	if confData.OutputType == "kafka" || len(confData.Kafka.Brokers) > 0 {
+		if err := loggensender.ValidateKafkaConf(confData.Kafka); err != nil {
+			log.WithFields(log.Fields{
+				"error_msg": err,
+			}).Fatal("The Kafka settings in the global config are not valid")
+		}
 	}
 
 	// Loop over all the data files, if any are present
@@ -391,17 +516,25 @@ func validateConfFile(confData *GlobalConfStore) {
 				}).Fatal("This regex in the conf file is not valid in the Go regex parser")
 			}
 
-			// Confirm the timestamp format is not blank (I couldn't find an err returning time function)
+			// Confirm the timestamp format is not blank
 			if replayFile.TimestampFormat == "" {
 				log.Fatal("All replay files must have a TimestampFormat")
 			}
 
+			// Confirm the timestamp format can render a timestamp
+			if err := loggenmunger.ValidateTimeFormat(replayFile.TimestampFormat); err != nil {
+				log.WithFields(log.Fields{
+					"TimestampFormat": replayFile.TimestampFormat,
+					"error_msg":       err,
+				}).Fatal("This timestamp format in the conf file is not valid")
+			}
+
 			// Confirm that a Repeat Interval is present
 			// This should be handled by JSON Marshaling, so I just need to check for zero
-			if replayFile.RepeatInterval == 0 {
+			if replayFile.RepeatInterval <= 0 {
 				log.WithFields(log.Fields{
 					"repeatInterval": replayFile.RepeatInterval,
-				}).Fatal("The repeat interval must be a non-zero integer")
+				}).Fatal("The repeat interval must be a positive integer")
 			}
 
 			// Confirm all the Headers have the needed fields, if any exist
@@ -417,34 +550,171 @@ func validateConfFile(confData *GlobalConfStore) {
 			}
 		}
 	}
+
+	// Loop over all dictionaries, if any are present
+	dictionaryNames := make(map[string]bool)
+	for _, dictionary := range confData.Dictionaries {
+		// Confirm the name and path are non-blank
+		if dictionary.Name == "" || dictionary.Path == "" {
+			log.WithFields(log.Fields{
+				"Name": dictionary.Name,
+				"Path": dictionary.Path,
+			}).Fatal("All dictionaries must have a non-blank name and path in the global config")
+		}
+
+		// Confirm the name is unique
+		if dictionaryNames[dictionary.Name] {
+			log.WithFields(log.Fields{
+				"Name": dictionary.Name,
+			}).Fatal("Dictionary names must be unique in the global config")
+		}
+		dictionaryNames[dictionary.Name] = true
+	}
+
+	// Loop over all rate profiles, if any are present
+	profileNames := make(map[string]bool)
+	for _, profile := range confData.RateProfiles {
+		// Confirm the name is non-blank and unique
+		if profile.Name == "" || profileNames[profile.Name] {
+			log.WithFields(log.Fields{
+				"Name": profile.Name,
+			}).Fatal("All rate profiles must have a unique, non-blank name in the global config")
+		}
+		profileNames[profile.Name] = true
+
+		// Confirm the profile can produce a rate
+		if err := validateRateProfile(profile); err != nil {
+			log.WithFields(log.Fields{
+				"Name":      profile.Name,
+				"error_msg": err,
+			}).Fatal("This rate profile in the conf file is not valid")
+		}
+	}
+
+	// Confirm the default rate profile exists
+	if confData.RateProfile != "" && !profileNames[confData.RateProfile] {
+		log.WithFields(log.Fields{
+			"RateProfile": confData.RateProfile,
+		}).Fatal("The default rate profile in the global config isn't defined in RateProfiles")
+	}
+
+	validateScenarios(confData)
+
+	// Confirm the output queue settings are valid
+	for output, queueConf := range confData.OutputQueues {
+		if err := loggensender.ValidateOutputQueue(output, queueConf); err != nil {
+			log.WithFields(log.Fields{
+				"output":    output,
+				"error_msg": err,
+			}).Fatal("This output queue in the conf file is not valid")
+		}
+	}
+
+	// Confirm the target rate is sensible, if there is one
+	if confData.TargetRate != nil {
+		validateTargetRate(confData.TargetRate)
+	}
 }
 
 // validateDataFile will do a sanity check on all values in a data file,
-// displaying useful errors and aborting if need be
+// displaying useful errors and aborting if need be. Lines that fail a check
+// are dropped, so nothing is sent for them.
 func validateDataFile(dataJSON *LogGenDataFile) {
+	var valid []loggensender.LogLineProperties
 
 	// Loop through all line objects in the file
 	if len(dataJSON.Lines) > 0 {
 		for _, logLine := range dataJSON.Lines {
 
-			//Confirm Text field exists
-			if logLine.Text == "" {
+			//Confirm Text field exists, unless the line is built from Fields
+			if logLine.Text == "" && logLine.Engine != "json" {
 				log.WithFields(log.Fields{
 					"lineJSON": logLine,
 				}).Error("Text field cannot be empty string or missing in data file JSON")
 				continue
 			}
 
-			// Confirm IntervalSecs or IntervalSecsMillis are not zero
-			if logLine.IntervalSecs == 0 && logLine.IntervalMillis == 0 {
+			// Confirm the line has a positive interval from IntervalSecs or IntervalMillis
+			if interval, _ := lineIntervalMillis(logLine); interval <= 0 {
 				log.WithFields(log.Fields{
 					"lineJSON": logLine,
-				}).Error("IntervalSecs and IntervalMillis fields cannot both be 0 or missing in data file JSON")
+				}).Error("IntervalSecs or IntervalMillis must be set to a positive number in data file JSON")
 				continue
 			}
 
 			// IntervalStdDev can be zero... so no sanity checks possible here
 
+			// Confirm the weight is not negative
+			if logLine.Weight < 0 {
+				log.WithFields(log.Fields{
+					"lineJSON": logLine,
+				}).Error("Weight field cannot be negative in data file JSON")
+				continue
+			}
+
+			// Confirm any Loki labels have names Loki will take
+			if err := loggensender.ValidateLokiLabels(logLine.LokiLabels); err != nil {
+				log.WithFields(log.Fields{
+					"lineJSON":  logLine,
+					"error_msg": err,
+				}).Error("LokiLabels are not valid in data file JSON")
+				continue
+			}
+
+			// Confirm the OTLP severity is one OTLP has
+			if err := loggensender.ValidateOTLPLine(logLine.OTLP); err != nil {
+				log.WithFields(log.Fields{
+					"lineJSON":  logLine,
+					"error_msg": err,
+				}).Error("OTLP settings are not valid in data file JSON")
+				continue
+			}
+
+			// Confirm the GELF level and field names are ones GELF takes
+			if err := loggensender.ValidateGELFLine(logLine.GELF); err != nil {
+				log.WithFields(log.Fields{
+					"lineJSON":  logLine,
+					"error_msg": err,
+				}).Error("GELF settings are not valid in data file JSON")
+				continue
+			}
+
+			// Confirm any date parts of the FilePath have good formats
+			if err := loggenmunger.ValidateDatePattern(logLine.FilePath); err != nil {
+				log.WithFields(log.Fields{
+					"lineJSON":  logLine,
+					"error_msg": err,
+				}).Error("FilePath is not valid in data file JSON")
+				continue
+			}
+
+			// Confirm any date parts of the ESIndex have good formats
+			if err := loggenmunger.ValidateDatePattern(logLine.ESIndex); err != nil {
+				log.WithFields(log.Fields{
+					"lineJSON":  logLine,
+					"error_msg": err,
+				}).Error("ESIndex is not valid in data file JSON")
+				continue
+			}
+
+			// Confirm the arrival model is valid
+			if err := validateArrivalModel(logLine); err != nil {
+				log.WithFields(log.Fields{
+					"lineJSON":  logLine,
+					"error_msg": err,
+				}).Error("ArrivalModel field is not valid in data file JSON")
+				continue
+			}
+
+			// Confirm the Engine is valid, and that its Text or Fields parse
+			if err := validateLineEngine(logLine); err != nil {
+				log.WithFields(log.Fields{
+					"lineJSON":  logLine,
+					"error_msg": err,
+				}).Error("Text, Fields or a wildcard field is not valid for the line in data file JSON")
+				continue
+			}
+
 			//Confirm Timestamp format field exists
 			if logLine.TimestampFormat == "" {
 				log.WithFields(log.Fields{
@@ -453,6 +723,23 @@ func validateDataFile(dataJSON *LogGenDataFile) {
 				continue
 			}
 
+			//Confirm Timestamp format can render a timestamp
+			if err := loggenmunger.ValidateTimeFormat(logLine.TimestampFormat); err != nil {
+				log.WithFields(log.Fields{
+					"lineJSON":  logLine,
+					"error_msg": err,
+				}).Error("TimestampFormat field is not a valid timestamp format in data file JSON")
+				continue
+			}
+
+			// Confirm the rate profile exists, if one is set
+			if _, ok := rateProfiles[logLine.RateProfile]; logLine.RateProfile != "" && !ok {
+				log.WithFields(log.Fields{
+					"lineJSON": logLine,
+				}).Error("RateProfile field doesn't match a rate profile in the global config")
+				continue
+			}
+
 			// No good way to check for this only when necessary
 			/*// Confirm the Start Time is valid
 			if r, _ := regexp.Compile(`^\d\d:\d\d:\d\d`); !(r.MatchString(logLine.StartTime)) {
@@ -472,11 +759,80 @@ func validateDataFile(dataJSON *LogGenDataFile) {
 				}
 			}
 
+			valid = append(valid, logLine)
+		}
+	}
+
+	if dropped := len(dataJSON.Lines) - len(valid); dropped > 0 {
+		log.WithFields(log.Fields{
+			"dropped": dropped,
+		}).Error("Dropped the data file lines that aren't valid")
+	}
+	dataJSON.Lines = valid
+}
+
+// validateLineEngine checks the Engine of a line, that its Text (or Fields
+// for json lines) can be rendered by that engine, and that the wildcards in
+// its other fields are valid
+func validateLineEngine(logLine loggensender.LogLineProperties) error {
+	var err error
+	switch logLine.Engine {
+	case "", "tokens":
+		err = loggenmunger.ValidateTokens(logLine.Text)
+	case "template":
+		err = loggenmunger.ValidateTemplate(logLine.Text)
+	case "json":
+		err = loggenmunger.ValidateFields(logLine.Fields)
+	default:
+		return errors.New("Engine field must be in (tokens, template, json): " + logLine.Engine)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, field := range lineTokenFields(logLine) {
+		if err := loggenmunger.ValidateTokens(field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lineTokenFields lists the fields of a line, other than its Text, that the
+// outputs render wildcards in
+func lineTokenFields(logLine loggensender.LogLineProperties) []string {
+	fields := []string{
+		logLine.FilePath, logLine.ESIndex, logLine.KafkaTopic, logLine.KafkaKey, logLine.FluentTag,
+		logLine.HEC.Host, logLine.HEC.Source, logLine.HEC.Sourcetype, logLine.HEC.Index,
+		logLine.OTLP.Severity, logLine.GELF.Level,
+	}
+	for _, set := range []map[string]string{logLine.LokiLabels, logLine.OTLP.Attributes, logLine.GELF.Fields} {
+		for _, value := range set {
+			fields = append(fields, value)
 		}
 	}
+	return fields
+}
+
+// confTokenFields lists the global settings that the outputs render
+// wildcards in
+func confTokenFields(confData *GlobalConfStore) []string {
+	fields := []string{
+		confData.FileOutputPath, confData.Elasticsearch.Index, confData.Kafka.Topic, confData.Kafka.Key, confData.Fluent.Tag,
+		confData.HEC.Host, confData.HEC.Source, confData.HEC.Sourcetype, confData.HEC.Index,
+		confData.OTLP.Severity, confData.GELF.Host, confData.GELF.Level,
+	}
+	for _, replayFile := range confData.ReplayFiles {
+		fields = append(fields, replayFile.FilePath)
+	}
+	for _, value := range confData.Loki.Labels {
+		fields = append(fields, value)
+	}
+	return fields
 }
 
 func main() {
+	parseFlags()
 	fmt.Println("Starting main program")
 
 	// Read in the config file
@@ -499,39 +855,174 @@ func main() {
 	fmt.Println("Config File Parsed")
 
 	validateConfFile(&confData)
+	loadRateProfiles(&confData)
+
+	// Load the dictionaries so they're shared across all lines
+	for _, dictionary := range confData.Dictionaries {
+		err = loggenmunger.LoadDictionary(dictionary)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"Name":      dictionary.Name,
+				"Path":      dictionary.Path,
+				"error_msg": err,
+			}).Fatal("Error in loading the dictionary file, exiting")
+		}
+	}
 
-	// Initialize the FileHandler if needed
+	// Set up the file output, opening the global output file now if it's used
+	outputPath := ""
 	if confData.OutputType == "file" {
-		f, err := os.Create(confData.FileOutputPath)
+		outputPath = confData.FileOutputPath
+	}
+	err = loggensender.StartFileOutput(outputPath, confData.FileOutput)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"FileOutputPath": confData.FileOutputPath,
+			"error_msg":      err,
+		}).Fatal("Error in opening the output file, exiting")
+	}
+
+	// Set up the Elasticsearch client if needed
+	if len(confData.Elasticsearch.URLs) > 0 {
+		err = loggensender.StartElasticsearch(confData.Elasticsearch)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"URLs":      confData.Elasticsearch.URLs,
+				"error_msg": err,
+			}).Fatal("Error in setting up Elasticsearch, exiting")
+		}
+	}
+
+	// Set up the Loki client if needed
+	if confData.Loki.URL != "" {
+		err = loggensender.StartLoki(confData.Loki)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"URL":       confData.Loki.URL,
+				"error_msg": err,
+			}).Fatal("Error in setting up Loki, exiting")
+		}
+	}
+
+	// Set up the OTLP exporter if needed
+	if confData.OTLP.Endpoint != "" {
+		err = loggensender.StartOTLP(confData.OTLP)
 		if err != nil {
 			log.WithFields(log.Fields{
-				"FileOutputPath": confData.FileOutputPath,
-				"error_msg":      err,
-			}).Fatal("Error in creating the output file, exiting")
+				"Endpoint":  confData.OTLP.Endpoint,
+				"error_msg": err,
+			}).Fatal("Error in setting up OTLP, exiting")
 		}
-		confData.FileHandler = f
-		defer f.Close()
+	}
+
+	// Set up the GELF connection if needed
+	if confData.GELF.Address != "" {
+		err = loggensender.StartGELF(confData.GELF)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"Address":   confData.GELF.Address,
+				"error_msg": err,
+			}).Fatal("Error in setting up GELF, exiting")
+		}
+	}
+
+	// Set up the Fluent output if needed
+	if confData.Fluent.Address != "" {
+		err = loggensender.StartFluent(confData.Fluent)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"Address":   confData.Fluent.Address,
+				"error_msg": err,
+			}).Fatal("Error in setting up Fluent, exiting")
+		}
+	}
+
+	// Set up the HEC client if needed
+	if confData.HEC.URL != "" {
+		err = loggensender.StartHEC(confData.HEC)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"URL":       confData.HEC.URL,
+				"error_msg": err,
+			}).Fatal("Error in setting up HEC, exiting")
+		}
+	}
+
+	// Connect to Kafka if needed
+	if len(confData.Kafka.Brokers) > 0 {
+		err = loggensender.StartKafkaProducer(confData.Kafka)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"Brokers":   confData.Kafka.Brokers,
+				"error_msg": err,
+			}).Fatal("Error in connecting to Kafka, exiting")
+		}
+	}
+
+	// Start a bounded queue in front of each output
+	err = loggensender.StartOutputQueues(confData.OutputQueues)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error_msg": err,
+		}).Fatal("Error in starting the output queues, exiting")
 	}
 
 	runQueue := make(chan loggensender.LogLineProperties)
 
 	//Spawn worker pool to keep the queue processing
+	var running sync.WaitGroup
 	for w := 1; w < workers; w++ {
-		go loggensender.RunLogLine(runQueue)
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			loggensender.RunLogLine(runQueue)
+		}()
 	}
 
 	// Add in some delay before starting because we're not sure how long it will take to parse the lines
 	targetStartTime := time.Now().Add(5 * time.Second).Truncate(time.Second)
 
 	// Create an object to store LogLines
-	logLines := parseAndStoreLogLines(confData, targetStartTime)
-
-	// Kick off sending of all log lines over a channel
-	queueLogLines(logLines, targetStartTime, runQueue)
+	logLines, flows := parseAndStoreLogLines(confData, targetStartTime)
+	scenarioLines, scenarioStarts := prepareScenarios(&confData, targetStartTime)
+
+	// Kick off sending of all log lines over a channel, either on their own
+	// intervals or shared out to hit the target rate
+	scheduler := newLineScheduler(runQueue)
+	go scheduler.run()
+	targetRateStop := make(chan chan bool)
+	if confData.TargetRate != nil {
+		go runTargetRate(*confData.TargetRate, logLines, targetStartTime, runQueue, targetRateStop)
+	} else {
+		queueLogLines(logLines, targetStartTime, scheduler)
+	}
+	startFlows(flows, targetStartTime, scheduler)
+	queueScenarioLines(scenarioLines, scenarioStarts, targetStartTime, scheduler)
 
 	fmt.Println("==== Successfully started the loggen process ====")
 
-	// Set up a channel that will never receive data to keep main loop open
-	delay := make(chan int)
-	<-delay
+	// Keep generating until interrupted. Then stop making new lines, let
+	// the workers render the ones already made, and send everything the
+	// output queues, batches and Kafka producer are holding, and write out
+	// the file output before exiting.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	received := <-stop
+	log.WithFields(log.Fields{
+		"signal": received,
+	}).Info("Stopping, flushing the outputs")
+
+	scheduler.stop()
+	if confData.TargetRate != nil {
+		done := make(chan bool)
+		targetRateStop <- done
+		<-done
+	}
+	close(runQueue)
+	running.Wait()
+
+	loggensender.StopOutputQueues()
+	loggensender.StopBatchers()
+	loggensender.StopKafkaProducer()
+	loggensender.StopFileOutput()
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// RateProfile shapes how often lines are sent over the day and week, so that
+// traffic has a realistic day/night and weekday/weekend pattern
+type RateProfile struct {
+	Name               string    `json:"Name"`
+	Type               string    `json:"Type"`
+	HourlyMultipliers  []float64 `json:"HourlyMultipliers"`
+	PeakHour           float64   `json:"PeakHour"`
+	Amplitude          float64   `json:"Amplitude"`
+	WeekdayMultipliers []float64 `json:"WeekdayMultipliers"`
+	Location           string    `json:"Location"`
+	location           *time.Location
+}
+
+// rateProfiles holds the rate profiles from the global conf by name
+var rateProfiles = make(map[string]*RateProfile)
+
+// validateRateProfile checks that a profile is complete, and that it can
+// never bring the rate down to zero
+func validateRateProfile(profile RateProfile) error {
+	switch profile.Type {
+	case "hourly":
+		if len(profile.HourlyMultipliers) != 24 {
+			return errors.New("Hourly profiles need exactly 24 HourlyMultipliers, got " + strconv.Itoa(len(profile.HourlyMultipliers)))
+		}
+		for _, multiplier := range profile.HourlyMultipliers {
+			if multiplier <= 0 {
+				return errors.New("HourlyMultipliers must all be positive")
+			}
+		}
+	case "sinusoid":
+		if profile.PeakHour < 0 || profile.PeakHour >= 24 {
+			return errors.New("PeakHour must be from 0 up to 24")
+		}
+		if profile.Amplitude < 0 || profile.Amplitude >= 1 {
+			return errors.New("Amplitude must be from 0 up to 1")
+		}
+	default:
+		return errors.New("Type must be in (hourly, sinusoid): " + profile.Type)
+	}
+
+	if len(profile.WeekdayMultipliers) != 0 && len(profile.WeekdayMultipliers) != 7 {
+		return errors.New("WeekdayMultipliers must have 7 values, starting with Sunday")
+	}
+	for _, multiplier := range profile.WeekdayMultipliers {
+		if multiplier <= 0 {
+			return errors.New("WeekdayMultipliers must all be positive")
+		}
+	}
+
+	if _, err := time.LoadLocation(profile.Location); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// loadRateProfiles stores the conf's rate profiles so lines can look them up
+func loadRateProfiles(confData *GlobalConfStore) {
+	for i := range confData.RateProfiles {
+		profile := confData.RateProfiles[i]
+		profile.location, _ = time.LoadLocation(profile.Location)
+		rateProfiles[profile.Name] = &profile
+	}
+}
+
+// multiplier works out how much faster than normal lines run at a given time
+func (p *RateProfile) multiplier(t time.Time) float64 {
+	t = t.In(p.location)
+	hour := float64(t.Hour()) + float64(t.Minute())/60 + float64(t.Second())/3600
+
+	var value float64
+	switch p.Type {
+	case "hourly":
+		// Blend between the hours so the rate doesn't jump on the hour
+		current := p.HourlyMultipliers[t.Hour()]
+		next := p.HourlyMultipliers[(t.Hour()+1)%24]
+		value = current + (next-current)*(hour-float64(t.Hour()))
+	case "sinusoid":
+		value = 1 + p.Amplitude*math.Cos(2*math.Pi*(hour-p.PeakHour)/24)
+	default:
+		value = 1
+	}
+
+	if len(p.WeekdayMultipliers) == 7 {
+		value *= p.WeekdayMultipliers[t.Weekday()]
+	}
+
+	return value
+}
+
+// rateProfileMultiplier looks up a profile by name and works out its
+// multiplier at a given time. Lines without a profile run at their normal rate.
+func rateProfileMultiplier(name string, t time.Time) float64 {
+	if name == "" {
+		return 1
+	}
+
+	profile, ok := rateProfiles[name]
+	if !ok {
+		log.WithFields(log.Fields{
+			"RateProfile": name,
+		}).Warn("Rate profile not found, running at the normal rate")
+		return 1
+	}
+
+	return profile.multiplier(t)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ftwynn/gologgen/loggenmunger"
+	"github.com/ftwynn/gologgen/loggensender"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Scenario is a time-bound incident layered on top of the normal log lines:
+// rate changes, silences, token overrides and extra lines
+type Scenario struct {
+	Name           string                           `json:"Name"`
+	Start          string                           `json:"Start"`
+	Duration       string                           `json:"Duration"`
+	Match          ScenarioMatch                    `json:"Match"`
+	RateMultiplier float64                          `json:"RateMultiplier"`
+	Silence        bool                             `json:"Silence"`
+	TokenOverrides []TokenOverride                  `json:"TokenOverrides"`
+	Lines          []loggensender.LogLineProperties `json:"Lines"`
+	startTime      time.Time
+	endTime        time.Time
+	textRegex      *regexp.Regexp
+}
+
+// ScenarioMatch picks the lines a scenario applies to. Blank values match
+// everything, so an empty match applies to all lines.
+type ScenarioMatch struct {
+	SourceFile string `json:"SourceFile"`
+	TextRegex  string `json:"TextRegex"`
+}
+
+// TokenOverride swaps one token (or any text) in matching lines for another
+type TokenOverride struct {
+	Token       string `json:"Token"`
+	Replacement string `json:"Replacement"`
+}
+
+// scenarios holds the scenarios from the global conf, once their times are resolved
+var scenarios []Scenario
+
+// validateScenarios does sanity checks on the scenarios in the global conf
+func validateScenarios(confData *GlobalConfStore) {
+	names := make(map[string]bool)
+	for _, scenario := range confData.Scenarios {
+		if scenario.Name == "" {
+			log.Fatal("All scenarios must have a non-blank name in the global config")
+		}
+		if names[scenario.Name] {
+			log.WithFields(log.Fields{
+				"scenario": scenario.Name,
+			}).Fatal("Scenario names must be unique in the global config")
+		}
+		names[scenario.Name] = true
+
+		if _, err := time.ParseDuration(scenario.Duration); err != nil || strings.HasPrefix(scenario.Duration, "-") {
+			log.WithFields(log.Fields{
+				"scenario": scenario.Name,
+				"Duration": scenario.Duration,
+			}).Fatal("Scenario Duration must be a positive duration, like 15m")
+		}
+
+		if _, err := resolveScenarioStart(scenario.Start, time.Now()); err != nil {
+			log.WithFields(log.Fields{
+				"scenario":  scenario.Name,
+				"Start":     scenario.Start,
+				"error_msg": err,
+			}).Fatal("Scenario Start must be relative to process start like +10m, a time of day like 14:00:00, or an RFC3339 timestamp")
+		}
+
+		if _, err := regexp.Compile(scenario.Match.TextRegex); err != nil {
+			log.WithFields(log.Fields{
+				"scenario":  scenario.Name,
+				"regex":     scenario.Match.TextRegex,
+				"error_msg": err,
+			}).Fatal("Scenario TextRegex is not valid in the Go regex parser")
+		}
+
+		if scenario.RateMultiplier < 0 {
+			log.WithFields(log.Fields{
+				"scenario":       scenario.Name,
+				"RateMultiplier": scenario.RateMultiplier,
+			}).Fatal("Scenario RateMultiplier cannot be negative")
+		}
+
+		for _, override := range scenario.TokenOverrides {
+			if override.Token == "" {
+				log.WithFields(log.Fields{
+					"scenario": scenario.Name,
+				}).Fatal("Scenario token overrides must have a non-blank Token")
+			}
+			if err := loggenmunger.ValidateTokens(override.Replacement); err != nil {
+				log.WithFields(log.Fields{
+					"scenario":  scenario.Name,
+					"error_msg": err,
+				}).Fatal("Scenario token override Replacement has an invalid wildcard")
+			}
+		}
+
+		for _, line := range scenario.Lines {
+			interval, _ := lineIntervalMillis(line)
+			if line.Text == "" && line.Engine != "json" || interval <= 0 || line.TimestampFormat == "" {
+				log.WithFields(log.Fields{
+					"scenario": scenario.Name,
+					"lineJSON": line,
+				}).Fatal("Scenario lines need a Text, a positive IntervalSecs or IntervalMillis, and a TimestampFormat")
+			}
+			if err := validateArrivalModel(line); err != nil {
+				log.WithFields(log.Fields{
+					"scenario":  scenario.Name,
+					"error_msg": err,
+				}).Fatal("Scenario line has an invalid ArrivalModel")
+			}
+			if err := validateLineEngine(line); err != nil {
+				log.WithFields(log.Fields{
+					"scenario":  scenario.Name,
+					"error_msg": err,
+				}).Fatal("Scenario line has an invalid Text or Fields")
+			}
+		}
+	}
+}
+
+// resolveScenarioStart turns a scenario's Start into a time. Starts can be
+// relative to the process start (+10m), a time of day (14:00:00) in the
+// same local time zone as a line's StartTime, or an RFC3339 timestamp. A
+// time of day that's already passed is tomorrow.
+func resolveScenarioStart(start string, processStart time.Time) (time.Time, error) {
+	if strings.HasPrefix(start, "+") {
+		offset, err := time.ParseDuration(strings.TrimPrefix(start, "+"))
+		return processStart.Add(offset), err
+	}
+
+	if clock, err := time.ParseInLocation("15:04:05", start, time.Local); err == nil {
+		local := processStart.In(time.Local)
+		at := time.Date(local.Year(), local.Month(), local.Day(), clock.Hour(), clock.Minute(), clock.Second(), 0, time.Local)
+		if at.Before(processStart) {
+			at = at.AddDate(0, 0, 1)
+		}
+		return at, nil
+	}
+
+	return time.Parse(time.RFC3339, start)
+}
+
+// prepareScenarios resolves the scenario times and regexes, and returns the
+// scenarios' extra lines along with the time each should start
+func prepareScenarios(confData *GlobalConfStore, processStart time.Time) (extraLines []loggensender.LogLineProperties, extraStarts []time.Time) {
+	for _, scenario := range confData.Scenarios {
+		scenario.startTime, _ = resolveScenarioStart(scenario.Start, processStart)
+		duration, _ := time.ParseDuration(scenario.Duration)
+		scenario.endTime = scenario.startTime.Add(duration)
+		if scenario.Match.TextRegex != "" {
+			scenario.textRegex = regexp.MustCompile(scenario.Match.TextRegex)
+		}
+
+		log.WithFields(log.Fields{
+			"scenario": scenario.Name,
+			"start":    scenario.startTime,
+			"end":      scenario.endTime,
+		}).Info("Scheduled scenario")
+
+		for i, line := range scenario.Lines {
+			line.Scenario = scenario.Name
+			line.LineID = "scenario:" + scenario.Name + ":" + strconv.Itoa(i)
+			line.SourceFile = "scenario:" + scenario.Name
+			applyLineDefaults(&line, confData)
+			extraLines = append(extraLines, line)
+			extraStarts = append(extraStarts, scenario.startTime)
+			scenario.Lines[i] = line
+		}
+
+		scenarios = append(scenarios, scenario)
+	}
+
+	return
+}
+
+// matches reports whether a scenario applies to a line
+func (s *Scenario) matches(line loggensender.LogLineProperties) bool {
+	if line.Scenario != "" {
+		return false
+	}
+	if s.Match.SourceFile != "" && s.Match.SourceFile != line.SourceFile {
+		return false
+	}
+	if s.textRegex != nil && !s.textRegex.MatchString(line.Text) {
+		return false
+	}
+	return true
+}
+
+// active reports whether a scenario is running at the given time
+func (s *Scenario) active(t time.Time) bool {
+	return !t.Before(s.startTime) && t.Before(s.endTime)
+}
+
+// scenarioEnded reports whether the scenario an extra line belongs to is over
+func scenarioEnded(name string, t time.Time) bool {
+	for i := range scenarios {
+		if scenarios[i].Name == name {
+			return !t.Before(scenarios[i].endTime)
+		}
+	}
+	return true
+}
+
+// applyScenarios works out what the running scenarios do to a line at the
+// given time: the line with any token overrides, the combined rate
+// multiplier, and whether the line is silenced
+func applyScenarios(line loggensender.LogLineProperties, t time.Time) (loggensender.LogLineProperties, float64, bool) {
+	multiplier := 1.0
+	silenced := false
+
+	for i := range scenarios {
+		scenario := &scenarios[i]
+		if !scenario.active(t) || !scenario.matches(line) {
+			continue
+		}
+
+		if scenario.Silence {
+			silenced = true
+		}
+		if scenario.RateMultiplier > 0 {
+			multiplier *= scenario.RateMultiplier
+		}
+		for _, override := range scenario.TokenOverrides {
+			line.Text = strings.Replace(line.Text, override.Token, override.Replacement, -1)
+			line.Fields = loggenmunger.ReplaceFieldValues(line.Fields, override.Token, override.Replacement)
+		}
+	}
+
+	return line, multiplier, silenced
+}
+
+// queueScenarioLines kicks off the extra lines of each scenario when the
+// scenario starts. Lines stop rescheduling themselves once it's over.
+// Scenarios that change the rate also have the lines they match rescheduled
+// when they start and end.
+func queueScenarioLines(lines []loggensender.LogLineProperties, starts []time.Time, tickerStart time.Time, scheduler *lineScheduler) {
+	for i := range scenarios {
+		scheduleRateChanges(&scenarios[i], tickerStart, scheduler)
+	}
+
+	for i, line := range lines {
+		start := starts[i]
+		if start.Before(tickerStart) {
+			start = tickerStart
+		}
+		if scenarioEnded(line.Scenario, start) {
+			log.WithFields(log.Fields{
+				"scenario": line.Scenario,
+			}).Warn("Scenario is already over, so its lines won't be sent")
+			continue
+		}
+
+		scheduler.add(line, start)
+	}
+}
+
+// scheduleRateChanges has the scheduler redraw the next send of every line a
+// scenario matches as the scenario starts and ends. Otherwise a new rate
+// only takes effect at each line's next send, so a long interval line
+// wouldn't spike when the scenario starts, and a slowed down line could
+// wait long past its end.
+func scheduleRateChanges(scenario *Scenario, tickerStart time.Time, scheduler *lineScheduler) {
+	if scenario.RateMultiplier == 0 || scenario.RateMultiplier == 1 {
+		return
+	}
+
+	for _, at := range []time.Time{scenario.startTime, scenario.endTime} {
+		// Lines are first scheduled with the scenarios already running
+		if at.Before(tickerStart) {
+			continue
+		}
+		scheduler.schedule(at, func(due time.Time) (time.Time, bool) {
+			scheduler.reschedule(due, scenario.matches)
+			return time.Time{}, false
+		})
+	}
+}
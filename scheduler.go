@@ -0,0 +1,239 @@
+package main
+
+import (
+	"container/heap"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/ftwynn/gologgen/loggensender"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// scheduledLine is a line waiting in the scheduler for its next send, or
+// something else the scheduler runs on time, like a flow's next step
+type scheduledLine struct {
+	next  time.Time
+	line  loggensender.LogLineProperties
+	state arrivalState
+
+	// fire is set for entries that aren't plain lines. It's called in the
+	// scheduler's goroutine when the entry is due, and returns when it's
+	// next due, or false if it's done.
+	fire func(due time.Time) (time.Time, bool)
+}
+
+// lineHeap orders the scheduled lines by their next send, soonest first
+type lineHeap []*scheduledLine
+
+func (h lineHeap) Len() int            { return len(h) }
+func (h lineHeap) Less(i, j int) bool  { return h[i].next.Before(h[j].next) }
+func (h lineHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *lineHeap) Push(x interface{}) { *h = append(*h, x.(*scheduledLine)) }
+func (h *lineHeap) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return last
+}
+
+// lineScheduler keeps every line in a single priority queue, and hands each
+// one to the worker pool when it's due. One goroutine does all the waiting,
+// however many lines there are.
+type lineScheduler struct {
+	mu       sync.Mutex
+	lines    lineHeap
+	wake     chan bool
+	stopping chan chan bool
+	runQueue chan loggensender.LogLineProperties
+	r        *rand.Rand
+}
+
+// newLineScheduler makes a scheduler that sends due lines to the run queue
+func newLineScheduler(runQueue chan loggensender.LogLineProperties) *lineScheduler {
+	return &lineScheduler{
+		wake:     make(chan bool, 1),
+		stopping: make(chan chan bool),
+		runQueue: runQueue,
+		r:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// add schedules a line's first send. It's safe to call while the scheduler runs.
+func (s *lineScheduler) add(line loggensender.LogLineProperties, at time.Time) {
+	log.WithFields(log.Fields{
+		"line":       line.Text,
+		"targetTime": at,
+	}).Debug("Scheduling line")
+
+	s.push(&scheduledLine{next: at, line: line})
+}
+
+// schedule has the scheduler call fire at a time, and again whenever fire
+// asks. It's safe to call while the scheduler runs, including from fire.
+func (s *lineScheduler) schedule(at time.Time, fire func(due time.Time) (time.Time, bool)) {
+	s.push(&scheduledLine{next: at, fire: fire})
+}
+
+// push adds an entry to the heap, and lets the scheduler know in case it's
+// due before the one it's waiting on
+func (s *lineScheduler) push(entry *scheduledLine) {
+	s.mu.Lock()
+	heap.Push(&s.lines, entry)
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- true:
+	default:
+	}
+}
+
+// reschedule redraws the next send of every line that match picks, as if
+// it had last been sent at the given time, and keeps whichever send is
+// sooner. It's only called from the scheduler's goroutine, like fire.
+func (s *lineScheduler) reschedule(at time.Time, match func(line loggensender.LogLineProperties) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, entry := range s.lines {
+		if entry.fire != nil || !match(entry.line) {
+			continue
+		}
+
+		_, multiplier, _ := applyScenarios(entry.line, at)
+		multiplier *= rateProfileMultiplier(entry.line.RateProfile, at)
+		next, state := nextArrival(entry.line, entry.state, at, multiplier, s.r)
+		if next.Before(entry.next) {
+			entry.next, entry.state = next, state
+		}
+	}
+	heap.Init(&s.lines)
+}
+
+// stop waits for the scheduler to finish sending what's due, and stops it
+// sending any more lines
+func (s *lineScheduler) stop() {
+	done := make(chan bool)
+	s.stopping <- done
+	<-done
+}
+
+// run waits for the soonest line to come due, sends it, and schedules its
+// next send, until it's stopped
+func (s *lineScheduler) run() {
+	timer := time.NewTimer(time.Hour)
+
+	for {
+		wait, ok := s.sendDue(time.Now())
+		if !ok {
+			select {
+			case <-s.wake:
+			case done := <-s.stopping:
+				done <- true
+				return
+			}
+			continue
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		case done := <-s.stopping:
+			timer.Stop()
+			done <- true
+			return
+		}
+	}
+}
+
+// sendDue sends every line that's due by now, and schedules their next
+// sends. It says how long until the soonest line after that, and is false
+// if there are no lines left.
+func (s *lineScheduler) sendDue(now time.Time) (time.Duration, bool) {
+	for {
+		s.mu.Lock()
+		if len(s.lines) == 0 {
+			s.mu.Unlock()
+			return 0, false
+		}
+
+		entry := s.lines[0]
+		if wait := entry.next.Sub(now); wait > 0 {
+			s.mu.Unlock()
+			return wait, true
+		}
+
+		heap.Pop(&s.lines)
+		s.mu.Unlock()
+
+		var again bool
+		if entry.fire != nil {
+			entry.next, again = entry.fire(entry.next)
+		} else {
+			again = s.send(entry)
+		}
+		if again {
+			s.mu.Lock()
+			heap.Push(&s.lines, entry)
+			s.mu.Unlock()
+		}
+	}
+}
+
+// send queues a due line for the workers, applying any scenarios, and works
+// out when it's next due. It's false if the line shouldn't run again.
+func (s *lineScheduler) send(entry *scheduledLine) bool {
+	targetTime := entry.next
+	logline := entry.line
+
+	// Lines that belong to a scenario stop once it's over
+	if logline.Scenario != "" && scenarioEnded(logline.Scenario, targetTime) {
+		log.WithFields(log.Fields{
+			"scenario": logline.Scenario,
+			"line":     logline.Text,
+		}).Debug("Scenario over, no longer scheduling line")
+		return false
+	}
+
+	// Apply any scenarios running right now
+	scenarioLine, multiplier, silenced := applyScenarios(logline, targetTime)
+
+	// Speed up or slow down for the time of day and week
+	multiplier *= rateProfileMultiplier(logline.RateProfile, targetTime)
+
+	if silenced {
+		log.WithFields(log.Fields{
+			"line":       logline.Text,
+			"targetTime": targetTime,
+		}).Debug("Line silenced by a scenario, skipping")
+	} else {
+		log.WithFields(log.Fields{
+			"line":       logline.Text,
+			"targetTime": targetTime,
+		}).Debug("Queuing line")
+
+		scenarioLine.ScheduledAt = targetTime
+		s.runQueue <- scenarioLine
+	}
+
+	// Calculate the next run time from when the line was due, rather than
+	// when it was actually sent, so that delays don't add up over time
+	entry.next, entry.state = nextArrival(logline, entry.state, targetTime, multiplier, s.r)
+
+	log.WithFields(log.Fields{
+		"line":     logline.Text,
+		"nextTime": entry.next,
+	}).Debug("SCHEDULED - Next log run")
+
+	return true
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"container/heap"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/ftwynn/gologgen/loggensender"
+)
+
+func TestLineHeapOrder(t *testing.T) {
+	base := time.Now()
+	offsets := []int{5, 1, 4, 2, 3, 0}
+
+	var lines lineHeap
+	for _, offset := range offsets {
+		heap.Push(&lines, &scheduledLine{next: base.Add(time.Duration(offset) * time.Second)})
+	}
+
+	for want := 0; want < len(offsets); want++ {
+		entry := heap.Pop(&lines).(*scheduledLine)
+		if got := int(entry.next.Sub(base) / time.Second); got != want {
+			t.Errorf("Failed case: popped %d >> %d", want, got)
+		}
+	}
+}
+
+func TestSchedulerSendDue(t *testing.T) {
+	runQueue := make(chan loggensender.LogLineProperties, 10)
+	s := newLineScheduler(runQueue)
+
+	now := time.Now()
+	due := now.Add(10 * time.Millisecond)
+	s.add(loggensender.LogLineProperties{Text: "later", IntervalSecs: 3600, ArrivalModel: "fixed"}, now.Add(time.Hour))
+	s.add(loggensender.LogLineProperties{Text: "soon", IntervalSecs: 60, ArrivalModel: "fixed"}, due)
+
+	// Adding a line wakes the scheduler, in case it's due before the line
+	// the scheduler is waiting on
+	select {
+	case <-s.wake:
+	default:
+		t.Errorf("Failed case: adding a line didn't wake the scheduler")
+	}
+
+	// Nothing is sent early, and each time the scheduler says how long to
+	// wait for the soonest line. Lines go back in the heap an interval
+	// after they were due.
+	cases := []struct {
+		now  time.Time
+		sent string
+		wait time.Duration
+	}{
+		{now, "", 10 * time.Millisecond},
+		{due, "soon", time.Minute},
+		{due.Add(time.Second), "", time.Minute - time.Second},
+		{due.Add(time.Minute), "soon", time.Minute},
+	}
+	for _, c := range cases {
+		wait, ok := s.sendDue(c.now)
+		if !ok || wait != c.wait {
+			t.Errorf("Failed case: at %v wait {%v,true} >> {%v,%v}", c.now.Sub(now), c.wait, wait, ok)
+		}
+
+		var sent string
+		select {
+		case line := <-runQueue:
+			sent = line.Text
+			if !line.ScheduledAt.Equal(c.now) {
+				t.Errorf("Failed case: %s scheduled at %v >> %v", sent, c.now.Sub(now), line.ScheduledAt.Sub(now))
+			}
+		default:
+		}
+		if sent != c.sent {
+			t.Errorf("Failed case: at %v sent %q >> %q", c.now.Sub(now), c.sent, sent)
+		}
+	}
+}
+
+func TestSchedulerFlows(t *testing.T) {
+	runQueue := make(chan loggensender.LogLineProperties, 10)
+	s := newLineScheduler(runQueue)
+
+	flow := FlowDefinition{
+		Name:          "login",
+		ArrivalRate:   0.001,
+		MaxConcurrent: 1,
+		Variables:     []FlowVariable{{Name: "user", Value: "$[alice||alice]"}},
+		Steps: []FlowStep{
+			{LogLineProperties: loggensender.LogLineProperties{Text: "start"}, Name: "start"},
+			{LogLineProperties: loggensender.LogLineProperties{Text: "end"}, Name: "end", DelayMillis: 50},
+		},
+	}
+	start := time.Now()
+	startFlows([]FlowDefinition{flow}, start, s)
+
+	// The first step goes when the flow starts, and the second one 50ms later
+	cases := []struct {
+		now  time.Time
+		text string
+	}{
+		{start.Add(49 * time.Millisecond), "start"},
+		{start.Add(50 * time.Millisecond), "end"},
+	}
+	var steps []loggensender.LogLineProperties
+	for _, c := range cases {
+		s.sendDue(c.now)
+		select {
+		case line := <-runQueue:
+			steps = append(steps, line)
+		default:
+			t.Fatalf("Failed case: %s step wasn't sent by %v", c.text, c.now.Sub(start))
+		}
+		if got := steps[len(steps)-1].Text; got != c.text {
+			t.Errorf("Failed case: %s >> %s", c.text, got)
+		}
+	}
+
+	if steps[0].Vars["user"] != "alice" || steps[1].Vars["user"] != "alice" {
+		t.Errorf("Failed case: {alice,alice} >> {%q,%q}", steps[0].Vars["user"], steps[1].Vars["user"])
+	}
+	if gap := steps[1].ScheduledAt.Sub(steps[0].ScheduledAt); gap != 50*time.Millisecond {
+		t.Errorf("Failed case: steps scheduled %v apart, not 50ms", gap)
+	}
+}
+
+func TestSchedulerRescheduleScenario(t *testing.T) {
+	base := time.Now()
+	scenarios = []Scenario{{
+		Name:           "spike",
+		RateMultiplier: 10,
+		startTime:      base,
+		endTime:        base.Add(time.Hour),
+		textRegex:      regexp.MustCompile("spiky"),
+	}}
+	defer func() { scenarios = nil }()
+
+	s := newLineScheduler(make(chan loggensender.LogLineProperties, 10))
+	s.add(loggensender.LogLineProperties{Text: "spiky", IntervalSecs: 3600, ArrivalModel: "fixed"}, base.Add(time.Hour))
+	s.add(loggensender.LogLineProperties{Text: "steady", IntervalSecs: 3600, ArrivalModel: "fixed"}, base.Add(time.Hour))
+	s.add(loggensender.LogLineProperties{Text: "spiky", IntervalSecs: 60, ArrivalModel: "fixed"}, base.Add(time.Second))
+
+	// Only the matched line that would otherwise wait out its long interval is moved up
+	s.reschedule(base, scenarios[0].matches)
+
+	cases := []struct {
+		text     string
+		interval int
+		next     time.Duration
+	}{
+		{"spiky", 3600, 6 * time.Minute},
+		{"steady", 3600, time.Hour},
+		{"spiky", 60, time.Second},
+	}
+	for _, c := range cases {
+		found := false
+		for _, entry := range s.lines {
+			if entry.line.Text != c.text || entry.line.IntervalSecs != c.interval {
+				continue
+			}
+			found = true
+			if got := entry.next.Sub(base); got != c.next {
+				t.Errorf("Failed case: %s every %ds: %v >> %v", c.text, c.interval, c.next, got)
+			}
+		}
+		if !found {
+			t.Errorf("Failed case: %s every %ds is missing", c.text, c.interval)
+		}
+	}
+	if got := s.lines[0].next.Sub(base); got != time.Second {
+		t.Errorf("Failed case: heap wasn't reordered, soonest %v >> %v", time.Second, got)
+	}
+}
+
+func TestSchedulerStop(t *testing.T) {
+	runQueue := make(chan loggensender.LogLineProperties, 10)
+	s := newLineScheduler(runQueue)
+	stopped := make(chan bool)
+	go func() {
+		s.run()
+		stopped <- true
+	}()
+
+	// Stopping works while the scheduler waits on a line, and nothing is
+	// sent after
+	s.add(loggensender.LogLineProperties{Text: "later", IntervalSecs: 3600, ArrivalModel: "fixed"}, time.Now().Add(time.Hour))
+	s.stop()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("Failed case: scheduler didn't stop")
+	}
+
+	s.add(loggensender.LogLineProperties{Text: "now", IntervalSecs: 60, ArrivalModel: "fixed"}, time.Now())
+	if len(runQueue) != 0 {
+		t.Errorf("Failed case: a line was sent after stopping")
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/ftwynn/gologgen/loggensender"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// TargetRateConf switches the scheduler from per-line intervals to sending a
+// fixed total number of events per second, shared out between the lines
+type TargetRateConf struct {
+	EPS            float64 `json:"EPS"`
+	RampFromEPS    float64 `json:"RampFromEPS"`
+	RampDuration   string  `json:"RampDuration"`
+	ReportInterval string  `json:"ReportInterval"`
+}
+
+// targetRateTick is how often the target rate scheduler sends what's due
+const targetRateTick = 10 * time.Millisecond
+
+// defaultReportInterval is how often the achieved rate is reported
+const defaultReportInterval = 10 * time.Second
+
+// targetShortfall is the share of the target rate the outputs must send at
+// before the report becomes a warning
+const targetShortfall = 0.9
+
+// validateTargetRate does sanity checks on the target rate in the global conf
+func validateTargetRate(target *TargetRateConf) {
+	if target.EPS <= 0 || target.RampFromEPS < 0 {
+		log.WithFields(log.Fields{
+			"EPS":         target.EPS,
+			"RampFromEPS": target.RampFromEPS,
+		}).Fatal("TargetRate EPS must be positive, and RampFromEPS cannot be negative")
+	}
+
+	for _, duration := range []string{target.RampDuration, target.ReportInterval} {
+		if duration == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(duration); err != nil || d <= 0 {
+			log.WithFields(log.Fields{
+				"duration": duration,
+			}).Fatal("TargetRate RampDuration and ReportInterval must be positive durations, like 5m")
+		}
+	}
+}
+
+// expectedEvents gives the total number of events that should have been sent
+// by some point after the start, following the ramp if there is one
+func (t *TargetRateConf) expectedEvents(elapsed time.Duration) float64 {
+	ramp, _ := time.ParseDuration(t.RampDuration)
+	if elapsed < ramp {
+		secs := elapsed.Seconds()
+		return t.RampFromEPS*secs + (t.EPS-t.RampFromEPS)*secs*secs/(2*ramp.Seconds())
+	}
+	return (t.RampFromEPS+t.EPS)/2*ramp.Seconds() + t.EPS*(elapsed-ramp).Seconds()
+}
+
+// weightedLines is a snapshot of the lines with their current weights, for
+// picking lines at random in proportion to their weight
+type weightedLines struct {
+	lines      []loggensender.LogLineProperties
+	cumWeights []float64
+}
+
+// snapshotWeights applies the scenarios and rate profiles running right now
+// to each line's weight
+func snapshotWeights(lines []loggensender.LogLineProperties, now time.Time) weightedLines {
+	snapshot := weightedLines{lines: make([]loggensender.LogLineProperties, len(lines)), cumWeights: make([]float64, len(lines))}
+
+	var total float64
+	for i, line := range lines {
+		scenarioLine, multiplier, silenced := applyScenarios(line, now)
+		snapshot.lines[i] = scenarioLine
+
+		weight := line.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		if !silenced {
+			total += weight * multiplier * rateProfileMultiplier(line.RateProfile, now)
+		}
+		snapshot.cumWeights[i] = total
+	}
+
+	return snapshot
+}
+
+// pick chooses a line at random by weight. It's false if every line is silenced.
+func (w *weightedLines) pick(r *rand.Rand) (loggensender.LogLineProperties, bool) {
+	if len(w.cumWeights) == 0 || w.cumWeights[len(w.cumWeights)-1] == 0 {
+		return loggensender.LogLineProperties{}, false
+	}
+
+	roll := r.Float64() * w.cumWeights[len(w.cumWeights)-1]
+	i := sort.SearchFloat64s(w.cumWeights, roll)
+	// Step over zero weight lines that share the same cumulative weight
+	for i < len(w.cumWeights)-1 && w.cumWeights[i] <= roll {
+		i++
+	}
+	return w.lines[i], true
+}
+
+// runTargetRate sends the lines at the target total rate, picking each line
+// at random by weight, and reports the achieved rate as it goes, until it's
+// told to stop
+func runTargetRate(target TargetRateConf, lines []loggensender.LogLineProperties, tickerStart time.Time, runQueue chan loggensender.LogLineProperties, stop chan chan bool) {
+	select {
+	case <-time.After(tickerStart.Sub(time.Now())):
+	case done := <-stop:
+		done <- true
+		return
+	}
+
+	reportInterval := defaultReportInterval
+	if target.ReportInterval != "" {
+		reportInterval, _ = time.ParseDuration(target.ReportInterval)
+	}
+
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	ticker := time.NewTicker(targetRateTick)
+	defer ticker.Stop()
+
+	var scheduled, queued int64
+	var reportExpected float64
+	reportStart := tickerStart
+	reportSent := loggensender.TargetRateSent()
+
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case done := <-stop:
+			done <- true
+			return
+		}
+
+		elapsed := now.Sub(tickerStart)
+		due := int64(target.expectedEvents(elapsed)) - scheduled
+
+		if due > 0 {
+			snapshot := snapshotWeights(lines, now)
+			for i := int64(0); i < due; i++ {
+				if line, ok := snapshot.pick(r); ok {
+					line.ScheduledAt = now
+					line.TargetRate = true
+					runQueue <- line
+					queued++
+				}
+			}
+			scheduled += due
+		}
+
+		// Report the average target rate since the last report, along with
+		// the rate lines were queued at and the rate the outputs sent them
+		// at, which leaves out lines that were dropped or failed to send
+		// along with flows and scenario lines
+		if since := now.Sub(reportStart); since >= reportInterval {
+			expected := target.expectedEvents(elapsed)
+			sent := loggensender.TargetRateSent()
+			targetEPS := (expected - reportExpected) / since.Seconds()
+			sentEPS := float64(sent-reportSent) / since.Seconds()
+			report := log.WithFields(log.Fields{
+				"target_eps": fmt.Sprintf("%.1f", targetEPS),
+				"queued_eps": fmt.Sprintf("%.1f", float64(queued)/since.Seconds()),
+				"sent_eps":   fmt.Sprintf("%.1f", sentEPS),
+			})
+			if sentEPS < targetEPS*targetShortfall {
+				report.Warn("Sent rate is falling short of the target rate")
+			} else {
+				report.Info("Target rate report")
+			}
+			queued = 0
+			reportSent = sent
+			reportExpected = expected
+			reportStart = now
+		}
+	}
+}